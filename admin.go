@@ -0,0 +1,221 @@
+package reverseguard
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminRefresh is the outcome of the on-demand refresh of a source.
+type adminRefresh struct {
+	Url       string `json:"url"`
+	Deny      bool   `json:"deny"`
+	Added     int    `json:"added"`
+	Removed   int    `json:"removed"`
+	Total     int    `json:"total"`
+	Unchanged bool   `json:"unchanged"`
+	Error     string `json:"error,omitempty"`
+}
+
+type adminResponse struct {
+	Guard   string          `json:"guard"`
+	Sources []*adminRefresh `json:"sources"`
+}
+
+// adminStats lists the shared sources of all the middleware instances along with their reference counts.
+type adminStats struct {
+	Sources []sourceStats `json:"sources"`
+}
+
+// init validates the admin endpoint options and parses the allowed subnets.
+func (a *Admin) init() error {
+	if !strings.HasPrefix(a.Path, "/") {
+		return fmt.Errorf("the path %q must start with a slash", a.Path)
+	}
+
+	if a.Token == "" {
+		return errors.New("no token")
+	}
+
+	token, err := resolveSecret("the \"token\" option", a.Token)
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		return errors.New("the token is empty")
+	}
+
+	if len(a.RawAllowedCIDRs) == 0 {
+		return errors.New("no allowed subnets (allowed_cidrs)")
+	}
+
+	for _, v := range a.RawAllowedCIDRs {
+		cidr, err := parseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("the allowed CIDR %q is invalid", v)
+		}
+
+		a.allowedCIDRs = append(a.allowedCIDRs, cidr)
+	}
+
+	a.RawAllowedCIDRs = nil
+
+	return nil
+}
+
+func (a *Admin) allowed(ip net.IP) bool {
+	for _, cidr := range a.allowedCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorized reports whether the request carries the token. The token is resolved on every request,
+// so a rotated one is picked up without a restart.
+func (a *Admin) authorized(req *http.Request) bool {
+	token, err := resolveSecret("the \"token\" option", a.Token)
+	if err != nil {
+		writeErr(fmt.Sprintf("Admin endpoint %q: %s", a.Path, err.Error()))
+		return false
+	}
+
+	scheme, given, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+
+	return strings.EqualFold(scheme, "Bearer") && token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// serveAdmin refreshes the dynamic sources of the guard given by the "guard" parameter right away, or only
+// the source given by the "url" parameter, on a POST request, and lists the registered sources on a GET request.
+// The requests from the subnets which are not allowed are not handled, so the endpoint stays invisible to them.
+// It reports whether the request has been handled.
+func (r *ReverseGuard) serveAdmin(rw http.ResponseWriter, req *http.Request, ip net.IP) bool {
+	admin := r.config.Admin
+
+	if admin == nil || req.URL.Path != admin.Path || !admin.allowed(ip) {
+		return false
+	}
+
+	if !admin.authorized(req) {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		// nop
+	case http.MethodGet:
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(&adminStats{Sources: registry.stats()})
+
+		return true
+	default:
+		rw.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+
+		return true
+	}
+
+	name := req.URL.Query().Get("guard")
+	url := req.URL.Query().Get("url")
+
+	proxy, ok := r.config.Map[name]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("the reverse proxy %q is not found", name), http.StatusNotFound)
+		return true
+	}
+
+	response := &adminResponse{Guard: name, Sources: make([]*adminRefresh, 0)}
+	status := http.StatusOK
+
+	refresh := func(dyn *DynamicCIDR, deny bool) {
+		if url != "" && dyn.Url != url {
+			return
+		}
+
+		item := r.refreshSource(name, dyn)
+		item.Deny = deny
+
+		if item.Error != "" {
+			status = http.StatusBadGateway
+		}
+
+		response.Sources = append(response.Sources, item)
+	}
+
+	for _, dyn := range proxy.DynamicCIDRs {
+		refresh(dyn, false)
+	}
+
+	for _, dyn := range proxy.DenyDynamicCIDRs {
+		refresh(dyn, true)
+	}
+
+	if url != "" && len(response.Sources) == 0 {
+		http.Error(rw, fmt.Sprintf("the reverse proxy %q has no endpoint %q", name, url), http.StatusNotFound)
+		return true
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(response)
+
+	return true
+}
+
+// refreshSource updates the shared source of the dynamic list right away and fans the changes out to its
+// subscribers. The update is serialized with the scheduled ones of the source.
+func (r *ReverseGuard) refreshSource(name string, dyn *DynamicCIDR) *adminRefresh {
+	item := &adminRefresh{Url: dyn.Url}
+
+	p := registry.lookup(dyn.key())
+	if p == nil {
+		item.Error = "the endpoint is not registered"
+		return item
+	}
+
+	result, err := p.source.update()
+	if err != nil {
+		writeErr(fmt.Sprintf("Reverse proxy %q, endpoint %q, failed to update subnet list on demand: %s", name, dyn.Url, err.Error()))
+
+		item.Error = err.Error()
+
+		return item
+	}
+
+	item.Added = result.added
+	item.Removed = result.removed
+	item.Total = result.total
+	item.Unchanged = result.unchanged
+
+	if result.unchanged {
+		writeOut(fmt.Sprintf("Reverse proxy %q, endpoint %q is unchanged on demand. Number of subnets: %d", name, dyn.Url, result.total))
+		return item
+	}
+
+	writeOut(fmt.Sprintf(
+		"Reverse proxy %q, endpoint %q has been updated on demand. New number of subnets: %d, added: %d, removed: %d%s",
+		name,
+		dyn.Url,
+		result.total,
+		result.added,
+		result.removed,
+		result.summary(),
+	))
+
+	p.publish()
+
+	// the expiry of the new entries is to be scheduled
+	p.notify()
+
+	return item
+}
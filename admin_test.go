@@ -0,0 +1,138 @@
+package reverseguard
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminEndpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the admin section.")
+	{
+		tests := []struct {
+			admin    *Admin
+			expected string
+		}{
+			{&Admin{Path: "admin", Token: "secret", RawAllowedCIDRs: []string{"10.0.0.0/8"}}, "the path \"admin\" must start with a slash"},
+			{&Admin{Path: "/admin", RawAllowedCIDRs: []string{"10.0.0.0/8"}}, "no token"},
+			{&Admin{Path: "/admin", Token: "env:REVERSEGUARD_TEST_MISSING", RawAllowedCIDRs: []string{"10.0.0.0/8"}}, "the environment variable \"REVERSEGUARD_TEST_MISSING\" of the \"token\" option is not set"},
+			{&Admin{Path: "/admin", Token: "secret"}, "no allowed subnets (allowed_cidrs)"},
+			{&Admin{Path: "/admin", Token: "secret", RawAllowedCIDRs: []string{"10.0.0.0/33"}}, "the allowed CIDR \"10.0.0.0/33\" is invalid"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {RawStaticCIDRs: []string{"192.0.2.0/24"}}}
+
+			_, err := New(ctx, next, &Config{Admin: test.admin, Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "error in the admin configuration", "An error message should point to the admin section.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the on-demand refresh of the sources.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n198.51.100.0/24\n")
+		t.Setenv("REVERSEGUARD_TEST_ADMIN_TOKEN", "secret")
+
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, RawInterval: "1h"}}}}
+		admin := &Admin{Path: "/.reverseguard", Token: "env:REVERSEGUARD_TEST_ADMIN_TOKEN", RawAllowedCIDRs: []string{"10.0.0.0/8"}}
+
+		handler, err := New(ctx, next, &Config{Admin: admin, Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		request := func(method, target, remoteAddr, token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, nil)
+			req.RemoteAddr = remoteAddr
+
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			return rw
+		}
+
+		tests := []struct {
+			method   string
+			target   string
+			addr     string
+			token    string
+			expected int
+		}{
+			{http.MethodPost, "/.reverseguard?guard=partner", "203.0.113.1:1234", "secret", http.StatusForbidden},
+			{http.MethodPost, "/.reverseguard?guard=partner", "10.0.0.1:1234", "", http.StatusUnauthorized},
+			{http.MethodPost, "/.reverseguard?guard=partner", "10.0.0.1:1234", "wrong", http.StatusUnauthorized},
+			{http.MethodDelete, "/.reverseguard?guard=partner", "10.0.0.1:1234", "secret", http.StatusMethodNotAllowed},
+			{http.MethodPost, "/.reverseguard?guard=unknown", "10.0.0.1:1234", "secret", http.StatusNotFound},
+			{http.MethodPost, "/.reverseguard?guard=partner&url=https://example.com", "10.0.0.1:1234", "secret", http.StatusNotFound},
+		}
+
+		for testId, test := range tests {
+			rw := request(test.method, test.target, test.addr, test.token)
+
+			t.Logf("\tTest %d: Whether the %s %s request from %s gets the status %d.", testId, test.method, test.target, test.addr, test.expected)
+			require.Equalf(t, test.expected, rw.Code, "The status code should be %d.", test.expected)
+		}
+
+		testId := len(tests)
+
+		server.set("192.0.2.0/24\n203.0.113.0/24\n")
+
+		rw := request(http.MethodPost, "/.reverseguard?guard=partner&url="+server.URL, "10.0.0.1:1234", "secret")
+
+		response := &adminResponse{}
+		require.NoErrorf(t, json.Unmarshal(rw.Body.Bytes(), response), "The response should be a JSON document.")
+
+		t.Logf("\tTest %d: Whether the source is refreshed on demand.", testId)
+		require.Equalf(t, http.StatusOK, rw.Code, "The refresh should succeed.")
+		require.Lenf(t, response.Sources, 1, "The source should be refreshed.")
+		require.Equalf(t, adminRefresh{Url: server.URL, Added: 1, Removed: 1, Total: 2}, *response.Sources[0], "The changes should be counted.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("203.0.113.1")), "The IP of the added subnet should be trusted right away.")
+		require.Nilf(t, plugin.lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP of the removed subnet should not be trusted.")
+
+		testId++
+
+		rw = request(http.MethodPost, "/.reverseguard?guard=partner", "10.0.0.1:1234", "secret")
+
+		response = &adminResponse{}
+		require.NoErrorf(t, json.Unmarshal(rw.Body.Bytes(), response), "The response should be a JSON document.")
+
+		t.Logf("\tTest %d: Whether a repeated refresh reports no changes.", testId)
+		require.Equalf(t, http.StatusOK, rw.Code, "The refresh should succeed.")
+		require.Equalf(t, adminRefresh{Url: server.URL, Total: 2}, *response.Sources[0], "No changes should be counted.")
+
+		testId++
+
+		rw = request(http.MethodGet, "/.reverseguard", "10.0.0.1:1234", "secret")
+
+		stats := &adminStats{}
+		require.NoErrorf(t, json.Unmarshal(rw.Body.Bytes(), stats), "The response should be a JSON document.")
+
+		var source *sourceStats
+		for i, v := range stats.Sources {
+			if v.Url == server.URL {
+				source = &stats.Sources[i]
+			}
+		}
+
+		t.Logf("\tTest %d: Whether the registered sources are listed.", testId)
+		require.Equalf(t, http.StatusOK, rw.Code, "The listing should succeed.")
+		require.NotNilf(t, source, "The source should be listed.")
+		require.Equalf(t, sourceStats{Url: server.URL, Subscribers: 1, Guards: []string{"partner"}, Interval: "1h0m0s", Subnets: 2}, *source, "The source should be described.")
+	}
+}
@@ -0,0 +1,163 @@
+package reverseguard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultCacheMaxAge = 7 * 24 * time.Hour
+
+// cacheEntry is the last successfully loaded subnet list of a dynamic source, stored on disk
+// to be used at startup when the source is unavailable.
+type cacheEntry struct {
+	Url          string    `json:"url"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checksum     string    `json:"checksum"`
+	CIDRs        []string  `json:"cidrs"`
+	Origins      []string  `json:"origins,omitempty"`
+	// Expires holds the expiry times (RFC 3339) of the entries, empty for the ones which never expire.
+	Expires []string `json:"expires,omitempty"`
+}
+
+func cacheChecksum(cidrs []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(cidrs, "\n")))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// cachePath returns the cache file of the source. The name depends on everything that affects
+// the resulting list: the url, the format options, the headers, the TLS options and so on.
+func (d *DynamicCIDR) cachePath() string {
+	sum := sha256.Sum256([]byte(d.listKey()))
+
+	return filepath.Join(d.cacheDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// saveCache atomically writes the current subnet list to the cache directory: the content is written
+// to a temporary file, which then replaces the cache file.
+func (d *DynamicCIDR) saveCache() error {
+	list := d.cidrs()
+	cidrs := make([]string, 0, len(list))
+	origins := make([]string, 0, len(list))
+	expires := make([]string, len(list))
+	var expiring bool
+	for i, v := range list {
+		cidrs = append(cidrs, v.cidr.String())
+		origins = append(origins, v.origin)
+
+		if !v.expires.IsZero() {
+			expires[i] = v.expires.Format(time.RFC3339)
+			expiring = true
+		}
+	}
+
+	if !expiring {
+		expires = nil
+	}
+
+	content, err := json.Marshal(&cacheEntry{
+		Url:          d.Url,
+		FetchedAt:    time.Now().UTC(),
+		ETag:         d.etag,
+		LastModified: d.lastModified,
+		Checksum:     cacheChecksum(cidrs),
+		CIDRs:        cidrs,
+		Origins:      origins,
+		Expires:      expires,
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(d.cacheDir, ".reverseguard-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := file.Name()
+
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, d.cachePath())
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// loadCache restores the subnet list and the HTTP cache validators from the cache directory.
+func (d *DynamicCIDR) loadCache() (*cacheEntry, error) {
+	content, err := os.ReadFile(d.cachePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New("no cached list")
+		}
+
+		return nil, err
+	}
+
+	entry := &cacheEntry{}
+
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, fmt.Errorf("the cached list is corrupted: %s", err.Error())
+	}
+
+	if entry.Checksum != cacheChecksum(entry.CIDRs) {
+		return nil, errors.New("the cached list is corrupted: checksum mismatch")
+	}
+
+	if age := time.Since(entry.FetchedAt); age > d.cacheMaxAge {
+		return nil, fmt.Errorf("the cached list is too old (fetched at %s)", entry.FetchedAt.Format(time.RFC822))
+	}
+
+	var CIDRList []cidrEntry
+
+	for i, v := range entry.CIDRs {
+		cidr, err := parseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("the cached list is corrupted: %s", err.Error())
+		}
+
+		origin := d.Url
+		if len(entry.Origins) == len(entry.CIDRs) {
+			origin = entry.Origins[i]
+		}
+
+		var expires time.Time
+		if len(entry.Expires) == len(entry.CIDRs) && entry.Expires[i] != "" {
+			expires, err = time.Parse(time.RFC3339, entry.Expires[i])
+			if err != nil {
+				return nil, fmt.Errorf("the cached list is corrupted: %s", err.Error())
+			}
+		}
+
+		CIDRList = append(CIDRList, cidrEntry{cidr: cidr, origin: origin, expires: expires})
+	}
+
+	d.setCIDRs(CIDRList)
+	d.etag = entry.ETag
+	d.lastModified = entry.LastModified
+	d.refreshedAt = entry.FetchedAt
+
+	return entry, nil
+}
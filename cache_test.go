@@ -0,0 +1,148 @@
+package reverseguard
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFallback(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the cache options.")
+	{
+		items := map[string]*ReverseProxy{"partner": {RawStaticCIDRs: []string{"192.0.2.0/24"}}}
+
+		_, err := New(ctx, next, &Config{Map: items, CacheDir: t.TempDir(), RawCacheMaxAge: "forever"}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an error occurs if the maximum cache age is invalid.", testId)
+		require.ErrorContainsf(t, err, "invalid duration \"forever\"", "An error message should contain information about the invalid duration.")
+	}
+
+	t.Log("Given the need to check the last-known-good persistence of dynamic lists.")
+	{
+		cacheDir := t.TempDir()
+		server := newListServer(t, "192.0.2.0/24\n198.51.100.0/24\n")
+
+		// every instance replaces the previous one, so the source is loaded anew rather than shared
+		cancel := context.CancelFunc(func() {})
+		defer func() { cancel() }()
+
+		newGuard := func(cfg *Config) (http.Handler, error) {
+			cancel()
+			waitUnregistered(t, server.URL)
+
+			var instanceCtx context.Context
+			instanceCtx, cancel = context.WithCancel(ctx)
+
+			return New(instanceCtx, next, cfg, "ReverseGuard")
+		}
+
+		newConfig := func(maxAge string) *Config {
+			return &Config{
+				CacheDir:       cacheDir,
+				RawCacheMaxAge: maxAge,
+				Map:            map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL}}}},
+			}
+		}
+
+		cfg := newConfig("")
+		_, err := newGuard(cfg)
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		cachePath := cfg.Map["partner"].DynamicCIDRs[0].cachePath()
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the loaded list is written to the cache directory without temporary files left.", testId)
+		entries, err := os.ReadDir(cacheDir)
+		require.NoErrorf(t, err, "The cache directory should be readable.")
+		require.Lenf(t, entries, 1, "The cache directory should contain the cache file only.")
+		require.Equalf(t, filepath.Base(cachePath), entries[0].Name(), "The cache directory should contain the cache file only.")
+
+		testId++
+
+		server.Close()
+
+		cfg = newConfig("")
+		handler, err := newGuard(cfg)
+
+		t.Logf("\tTest %d: Whether the cached list is used when the source is unavailable.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the cached list is available.")
+		require.NotNilf(t, handler.(*ReverseGuard).lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP from the cached list should be trusted.")
+
+		testId++
+
+		content, err := os.ReadFile(cachePath)
+		require.NoErrorf(t, err, "The cache file should be readable.")
+
+		entry := &cacheEntry{}
+		require.NoErrorf(t, json.Unmarshal(content, entry), "The cache file should be valid.")
+
+		entry.FetchedAt = time.Now().Add(-2 * time.Hour)
+		content, _ = json.Marshal(entry)
+		require.NoErrorf(t, os.WriteFile(cachePath, content, 0o600), "The cache file should be writable.")
+
+		_, err = newGuard(newConfig("1h"))
+
+		t.Logf("\tTest %d: Whether the cached list older than the maximum cache age is rejected.", testId)
+		require.ErrorContainsf(t, err, "the cached list is too old", "An error message should contain information about the outdated cache.")
+
+		testId++
+
+		entry.CIDRs = append(entry.CIDRs, "0.0.0.0/0")
+		content, _ = json.Marshal(entry)
+		require.NoErrorf(t, os.WriteFile(cachePath, content, 0o600), "The cache file should be writable.")
+
+		_, err = newGuard(newConfig(""))
+
+		t.Logf("\tTest %d: Whether the tampered cached list is rejected.", testId)
+		require.ErrorContainsf(t, err, "checksum mismatch", "An error message should contain information about the corrupted cache.")
+
+		testId++
+
+		require.NoErrorf(t, os.Remove(cachePath), "The cache file should be removable.")
+
+		_, err = newGuard(newConfig(""))
+
+		t.Logf("\tTest %d: Whether an error occurs if neither the source nor the cached list are available.", testId)
+		require.ErrorContainsf(t, err, "no cached list", "An error message should contain information about the missing cache.")
+	}
+
+	t.Log("Given the need to check that the sources of the same url getting different lists do not share the cache file.")
+	{
+		const url = "https://lists.example.com/partners.txt"
+
+		base := &DynamicCIDR{Url: url, Headers: map[string]string{"Authorization": "env:TENANT_A_TOKEN"}}
+
+		tests := []struct {
+			name        string
+			dynamicCIDR *DynamicCIDR
+		}{
+			{"other headers", &DynamicCIDR{Url: url, Headers: map[string]string{"Authorization": "env:TENANT_B_TOKEN"}}},
+			{"no headers", &DynamicCIDR{Url: url}},
+			{"TLS client certificate", &DynamicCIDR{Url: url, Headers: base.Headers, TLS: &SourceTLS{CertFile: "client.crt", KeyFile: "client.key"}}},
+		}
+
+		for testId, test := range tests {
+			t.Logf("\tTest %d: Whether the source with %s gets its own cache file.", testId, test.name)
+			require.NotEqualf(t, base.cachePath(), test.dynamicCIDR.cachePath(), "The cache files should differ.")
+		}
+
+		testId := len(tests)
+
+		same := &DynamicCIDR{Url: url, Headers: base.Headers, cacheMaxAge: time.Hour}
+
+		t.Logf("\tTest %d: Whether the cache options do not affect the cache file.", testId)
+		require.Equalf(t, base.cachePath(), same.cachePath(), "The cache files should be the same.")
+	}
+}
@@ -0,0 +1,318 @@
+package reverseguard
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxBytes  = 10 << 20
+	defaultTimeout   = 30 * time.Second
+	defaultUserAgent = "ReverseGuard (+https://github.com/WagnerPMC/reverseguard)"
+)
+
+// sourceTransport is shared by all the remote subnet sources, so the connections are reused between refreshes.
+// The per-request deadline is set by the source timeout alone, including the wait for the response headers.
+var sourceTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:   true,
+	MaxIdleConnsPerHost: 2,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+var sourceClient = &http.Client{Transport: sourceTransport, CheckRedirect: checkSourceRedirect}
+
+// sourceHeadersKey is the context key of the names of the headers set from the options of the source.
+type sourceHeadersKey struct{}
+
+// checkSourceRedirect follows up to 10 redirects, as the default policy does. The client drops only the
+// Authorization and Cookie headers on a redirect to another host, so all the headers of the source are
+// dropped there, since any of them may hold a secret.
+func checkSourceRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		return nil
+	}
+
+	names, _ := req.Context().Value(sourceHeadersKey{}).([]string)
+	for _, name := range names {
+		req.Header.Del(name)
+	}
+
+	return nil
+}
+
+// tlsClients are the clients of the sources with custom TLS options, keyed by the options. Each of them uses
+// a clone of the shared transport, since the TLS configuration is a property of the transport.
+var tlsClients = make(map[string]*http.Client)
+var tlsClientsMu sync.Mutex
+
+// client returns the HTTP client of the source.
+func (d *DynamicCIDR) client() (*http.Client, error) {
+	if d.TLS == nil {
+		return sourceClient, nil
+	}
+
+	key := d.TLS.key()
+
+	tlsClientsMu.Lock()
+	defer tlsClientsMu.Unlock()
+
+	if client, ok := tlsClients[key]; ok {
+		return client, nil
+	}
+
+	config, err := d.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := sourceTransport.Clone()
+	transport.TLSClientConfig = config
+
+	client := &http.Client{Transport: transport, CheckRedirect: checkSourceRedirect}
+	tlsClients[key] = client
+
+	return client, nil
+}
+
+// resolveHeader returns the value of the header option. The "env:NAME" values are taken from the environment
+// variables and the "file:/path" values from the files (without the trailing newline), so secrets stay out
+// of the configuration. Both are resolved on every request to pick up the rotated secrets.
+func resolveHeader(name, value string) (string, error) {
+	return resolveSecret(fmt.Sprintf("the header %q", name), value)
+}
+
+// resolveSecret returns the value of the option, taken from the environment variable or the file it refers to, if any.
+func resolveSecret(option, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		variable := value[4:]
+
+		v, ok := os.LookupEnv(variable)
+		if !ok {
+			return "", fmt.Errorf("the environment variable %q of %s is not set", variable, option)
+		}
+
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		content, err := os.ReadFile(value[5:])
+		if err != nil {
+			return "", fmt.Errorf("unable to read the value of %s: %s", option, err.Error())
+		}
+
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	return value, nil
+}
+
+// newRequest creates a request to the url on behalf of the source. The headers of the source are sent
+// only if they are requested, since they may hold the credentials of the list.
+func (d *DynamicCIDR) newRequest(ctx context.Context, url string, withHeaders bool) (*http.Request, error) {
+	var names []string
+	if withHeaders {
+		for name := range d.Headers {
+			names = append(names, name)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, sourceHeadersKey{}, names), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", d.UserAgent)
+
+	if !withHeaders {
+		return req, nil
+	}
+
+	for name, value := range d.Headers {
+		resolved, err := resolveHeader(name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set(name, resolved)
+	}
+
+	return req, nil
+}
+
+// fetchHTTP downloads the subnet list. The validators of the last accepted response are sent along, so the server
+// may answer with 304 Not Modified instead of the whole list. The body is read up to the max_bytes limit of the source.
+func (d *DynamicCIDR) fetchHTTP() (*readResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	req, err := d.newRequest(ctx, d.Url, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.etag != "" {
+		req.Header.Set("If-None-Match", d.etag)
+	}
+
+	if d.lastModified != "" {
+		req.Header.Set("If-Modified-Since", d.lastModified)
+	}
+
+	client, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return &readResult{notModified: true}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response code %d is not acceptable", resp.StatusCode)
+	}
+
+	buff, err := io.ReadAll(io.LimitReader(resp.Body, d.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(buff)) > d.MaxBytes {
+		return nil, fmt.Errorf("the response body exceeds the limit of %d bytes (max_bytes)", d.MaxBytes)
+	}
+
+	return &readResult{
+		documents:    []sourceDocument{{origin: d.Url, content: buff}},
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// fetchSignature downloads the detached signature of the subnet list. The signature is never cached,
+// since it is only requested along with the changed list. The headers of the source are sent along
+// only if the signature is served by the host of the list.
+func (d *DynamicCIDR) fetchSignature(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	req, err := d.newRequest(ctx, url, sameHost(url, d.Url))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response code %d is not acceptable", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxSignatureBytes))
+}
+
+// sameHost reports whether both urls point to the same host and port.
+func sameHost(a, b string) bool {
+	first, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+
+	second, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(first.Host, second.Host)
+}
+
+func (t *SourceTLS) key() string {
+	return strings.Join([]string{t.CAFile, t.CertFile, t.KeyFile, t.ServerName}, "\n")
+}
+
+// init validates the TLS options of the source.
+func (t *SourceTLS) init() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("the \"tls.cert_file\" and \"tls.key_file\" options must be set together")
+	}
+
+	_, err := t.config()
+
+	return err
+}
+
+// config builds the TLS configuration of the source. The CA bundle is loaded once, whereas the client certificate
+// is loaded on every handshake, so the rotated certificate is picked up without a restart.
+func (t *SourceTLS) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if t.CAFile != "" {
+		content, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA file %q: %s", t.CAFile, err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("the CA file %q contains no PEM certificates", t.CAFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if t.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate %q: %s", t.CertFile, err.Error())
+		}
+
+		certFile, keyFile := t.CertFile, t.KeyFile
+
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load the client certificate %q: %s", certFile, err.Error())
+			}
+
+			return &cert, nil
+		}
+	}
+
+	return config, nil
+}
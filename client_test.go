@@ -0,0 +1,412 @@
+package reverseguard
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoteSourceLimits(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	var list strings.Builder
+	for i := 0; i < 256; i++ {
+		_, _ = fmt.Fprintf(&list, "10.0.%d.0/24\n", i)
+	}
+
+	t.Log("Given the need to check probably errors in the limit options of dynamic_cidrs sections.")
+	{
+		server := newListServer(t, list.String())
+
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: server.URL, MaxBytes: -1}, "\"max_bytes\" option must not be negative"},
+			{&DynamicCIDR{Url: server.URL, RawTimeout: "soon"}, "invalid timeout \"soon\""},
+			{&DynamicCIDR{Url: server.URL, RawTimeout: "-1s"}, "invalid timeout \"-1s\""},
+			{&DynamicCIDR{Url: server.URL, MaxBytes: 100}, "exceeds the limit of 100 bytes"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "partner", "An error message should contain a name of configuration in which an error occurred.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the downloading of remote subnet lists.")
+	{
+		var userAgent string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			userAgent = req.UserAgent()
+
+			if req.URL.Path == "/slow" {
+				time.Sleep(500 * time.Millisecond)
+			}
+
+			_, _ = rw.Write([]byte(list.String()))
+		}))
+		t.Cleanup(server.Close)
+
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL}}}}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether a list larger than 2000 bytes is accepted by default.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the list fits the default limit.")
+		require.Lenf(t, items["partner"].DynamicCIDRs[0].cidrs(), 256, "All the subnets should be loaded.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether the default User-Agent is sent.", testId)
+		require.Equalf(t, defaultUserAgent, userAgent, "The default User-Agent should be sent.")
+
+		testId++
+
+		items = map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, UserAgent: "acme/1.0"}}}}
+
+		_, err = New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		t.Logf("\tTest %d: Whether the configured User-Agent is sent.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+		require.Equalf(t, "acme/1.0", userAgent, "The configured User-Agent should be sent.")
+
+		testId++
+
+		items = map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL + "/slow", RawTimeout: "50ms"}}}}
+
+		_, err = New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		t.Logf("\tTest %d: Whether the download is interrupted by the timeout.", testId)
+		require.ErrorContainsf(t, err, "deadline exceeded", "An error message should contain information about the timeout.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether the wait for the response headers is limited by the source timeout only.", testId)
+		require.Zerof(t, sourceTransport.ResponseHeaderTimeout, "The shared transport should not cut the timeouts above its own limit.")
+
+		testId++
+
+		invalidServer := newListServer(t, "192.0.2.0/24\nnot-a-subnet\n")
+		items = map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: invalidServer.URL}}}}
+
+		_, err = New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		t.Logf("\tTest %d: Whether an error message points to the invalid entry.", testId)
+		require.ErrorContainsf(t, err, "invalid entry \"not-a-subnet\" at line 2", "An error message should point to the invalid entry.")
+	}
+}
+
+func TestConditionalFetch(t *testing.T) {
+	t.Log("Given the need to check the conditional downloading of remote subnet lists.")
+	{
+		var mu sync.Mutex
+		content, etag, lastModified := "192.0.2.0/24\n", `"v1"`, "Wed, 11 Oct 2023 00:00:00 GMT"
+		var ifNoneMatch, ifModifiedSince string
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			ifNoneMatch, ifModifiedSince = req.Header.Get("If-None-Match"), req.Header.Get("If-Modified-Since")
+
+			if ifNoneMatch == etag {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			rw.Header().Set("ETag", etag)
+			rw.Header().Set("Last-Modified", lastModified)
+			_, _ = rw.Write([]byte(content))
+		}))
+		t.Cleanup(server.Close)
+
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL}}}}
+
+		_, err := New(context.Background(), http.NotFoundHandler(), &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		dynamicCIDR := items["partner"].DynamicCIDRs[0]
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether no validators are sent with the first request.", testId)
+		require.Emptyf(t, ifNoneMatch, "The If-None-Match header should not be sent.")
+		require.Emptyf(t, ifModifiedSince, "The If-Modified-Since header should not be sent.")
+
+		testId++
+
+		result, err := dynamicCIDR.update()
+		require.NoErrorf(t, err, "An error should not occur while updating the list.")
+
+		t.Logf("\tTest %d: Whether the validators of the last response are sent and the list is kept on 304.", testId)
+		require.Equalf(t, `"v1"`, ifNoneMatch, "The If-None-Match header should contain the last ETag.")
+		require.Equalf(t, "Wed, 11 Oct 2023 00:00:00 GMT", ifModifiedSince, "The If-Modified-Since header should contain the last Last-Modified.")
+		require.Truef(t, result.unchanged, "The list should be reported as unchanged.")
+		require.Equalf(t, 1, result.total, "The number of subnets should be reported.")
+		require.Lenf(t, dynamicCIDR.cidrs(), 1, "The list should be kept.")
+
+		testId++
+
+		mu.Lock()
+		content, etag = "192.0.2.0/24\n198.51.100.0/24\n", `"v2"`
+		mu.Unlock()
+
+		result, err = dynamicCIDR.update()
+		require.NoErrorf(t, err, "An error should not occur while updating the list.")
+
+		t.Logf("\tTest %d: Whether the changed list is downloaded and its validators are remembered.", testId)
+		require.Falsef(t, result.unchanged, "The list should be reported as changed.")
+		require.Lenf(t, dynamicCIDR.cidrs(), 2, "The list should be replaced.")
+		require.Equalf(t, `"v2"`, dynamicCIDR.etag, "The new ETag should be remembered.")
+
+		testId++
+
+		mu.Lock()
+		etag = `"v3"`
+		mu.Unlock()
+
+		result, err = dynamicCIDR.update()
+		require.NoErrorf(t, err, "An error should not occur while updating the list.")
+
+		t.Logf("\tTest %d: Whether the list downloaded again with the same content is kept as a whole.", testId)
+		require.Equalf(t, 2, result.total, "All the subnets should be kept.")
+		require.Lenf(t, dynamicCIDR.cidrs(), 2, "All the subnets should be kept.")
+	}
+}
+
+// writeClientCertificate generates a self-signed client certificate and writes it along with the key to the directory.
+func writeClientCertificate(t testing.TB, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoErrorf(t, err, "The key should be generated.")
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "reverseguard"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoErrorf(t, err, "The certificate should be created.")
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoErrorf(t, err, "The certificate should be parsed.")
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoErrorf(t, err, "The key should be marshalled.")
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoErrorf(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600), "The certificate should be written.")
+	require.NoErrorf(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600), "The key should be written.")
+
+	return cert, certFile, keyFile
+}
+
+func TestAuthenticatedSources(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	dir := t.TempDir()
+
+	t.Log("Given the need to check the headers of remote sources.")
+	{
+		var mu sync.Mutex
+		var received http.Header
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			received = req.Header.Clone()
+			_, _ = rw.Write([]byte("192.0.2.0/24\n"))
+		}))
+		t.Cleanup(server.Close)
+
+		tokenFile := filepath.Join(dir, "token")
+		require.NoErrorf(t, os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0o600), "The token file should be writable.")
+		t.Setenv("REVERSEGUARD_TEST_TOKEN", "Bearer t0k3n")
+
+		headers := map[string]string{
+			"Authorization": "env:REVERSEGUARD_TEST_TOKEN",
+			"X-Api-Key":     "file:" + tokenFile,
+			"X-Tenant":      "acme",
+		}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, Headers: headers}}}}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		tests := []struct {
+			header   string
+			expected string
+		}{
+			{"Authorization", "Bearer t0k3n"},
+			{"X-Api-Key", "s3cr3t"},
+			{"X-Tenant", "acme"},
+		}
+
+		for testId, test := range tests {
+			t.Logf("\tTest %d: Whether the %s header is sent as %q.", testId, test.header, test.expected)
+			require.Equalf(t, test.expected, received.Get(test.header), "The %s header should be resolved.", test.header)
+		}
+	}
+
+	t.Log("Given the need to check that the headers of remote sources are not sent to another host on a redirect.")
+	{
+		var mu sync.Mutex
+		received := make(map[string]string)
+
+		// newServer serves the list at /list, keeping the X-Api-Key header it gets, and redirects /same to it
+		newServer := func(name string) *httptest.Server {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/same" {
+					http.Redirect(rw, req, "/list", http.StatusFound)
+					return
+				}
+
+				mu.Lock()
+				received[name] = req.Header.Get("X-Api-Key")
+				mu.Unlock()
+
+				_, _ = rw.Write([]byte("192.0.2.0/24\n"))
+			}))
+			t.Cleanup(server.Close)
+
+			return server
+		}
+
+		origin := newServer("origin")
+		target := newServer("target")
+
+		redirector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			http.Redirect(rw, req, target.URL+"/list", http.StatusFound)
+		}))
+		t.Cleanup(redirector.Close)
+
+		tests := []struct {
+			url      string
+			server   string
+			expected string
+		}{
+			{origin.URL + "/same", "origin", "secret"},
+			{redirector.URL + "/list", "target", ""},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: test.url, Headers: map[string]string{"X-Api-Key": "secret"}}}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+			require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+			mu.Lock()
+			value, ok := received[test.server]
+			mu.Unlock()
+
+			t.Logf("\tTest %d: Whether the redirect from %s sends the X-Api-Key header %q.", testId, test.url, test.expected)
+			require.Truef(t, ok, "The list should be requested from the %s server.", test.server)
+			require.Equalf(t, test.expected, value, "The headers should only be sent to the host of the list.")
+		}
+	}
+
+	t.Log("Given the need to check probably errors in the headers and the TLS options of remote sources.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: server.URL, Headers: map[string]string{"Authorization": "env:REVERSEGUARD_TEST_MISSING"}}, "the environment variable \"REVERSEGUARD_TEST_MISSING\" of the header \"Authorization\" is not set"},
+			{&DynamicCIDR{Url: server.URL, Headers: map[string]string{"Authorization": "file:" + filepath.Join(dir, "missing")}}, "unable to read the value of the header \"Authorization\""},
+			{&DynamicCIDR{Url: server.URL, TLS: &SourceTLS{CertFile: "client.crt"}}, "must be set together"},
+			{&DynamicCIDR{Url: server.URL, TLS: &SourceTLS{CAFile: filepath.Join(dir, "missing.pem")}}, "unable to read the CA file"},
+			{&DynamicCIDR{Url: server.URL, TLS: &SourceTLS{CAFile: filepath.Join(dir, "token")}}, "contains no PEM certificates"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "partner", "An error message should contain a name of configuration in which an error occurred.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the TLS options of remote sources.")
+	{
+		clientCert, certFile, keyFile := writeClientCertificate(t, dir)
+
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(clientCert)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte("192.0.2.0/24\n"))
+		}))
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+		server.StartTLS()
+		t.Cleanup(server.Close)
+
+		caFile := filepath.Join(dir, "ca.pem")
+		require.NoErrorf(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600), "The CA file should be writable.")
+
+		tests := []struct {
+			name     string
+			tls      *SourceTLS
+			expected string
+		}{
+			{"no private CA", nil, "certificate"},
+			{"no client certificate", &SourceTLS{CAFile: caFile}, "certificate"},
+			{"wrong server name", &SourceTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "wrong.example"}, "wrong.example"},
+			{"mTLS", &SourceTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, ""},
+			{"mTLS with the server name", &SourceTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"}, ""},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, TLS: test.tls}}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			if test.expected != "" {
+				t.Logf("\tTest %d: Whether the connection with %s fails.", testId, test.name)
+				require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+				continue
+			}
+
+			t.Logf("\tTest %d: Whether the connection with %s succeeds.", testId, test.name)
+			require.NoErrorf(t, err, "An error should not occur if the TLS options are valid.")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package reverseguard
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseIP parses an IPv4 or IPv6 address, possibly enclosed in square brackets and followed by a zone ID
+// (fe80::1%eth0). IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are normalized to IPv4 ones, so they match
+// the IPv4 subnets.
+func parseIP(s string) (net.IP, error) {
+	host := strings.TrimSpace(s)
+
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a valid IP address", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+
+	return ip, nil
+}
+
+// parseRemoteAddr extracts the client IP from the http.Request.RemoteAddr value. Both "host:port" and bare host
+// forms are accepted.
+func parseRemoteAddr(remoteAddr string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// no port
+		host = remoteAddr
+	}
+
+	return parseIP(host)
+}
+
+// parseCIDR parses a subnet in the CIDR notation. A bare IP address is treated as a single-host subnet
+// (/32 for IPv4, /128 for IPv6).
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.Contains(s, "/") {
+		ip, err := parseIP(s)
+		if err != nil {
+			return nil, err
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return cidr, nil
+}
+
+// resolve finds the real client IP. If the peer is a trusted hop, the chain of addresses from the configured
+// header is walked right-to-left, skipping the trusted hops, and the first untrusted address is returned.
+// If all the addresses in the chain are trusted, the leftmost one is returned. A request from a trusted hop
+// without the header is rejected, since the hop itself is not the client.
+func (c *ClientIP) resolve(peer net.IP, header http.Header) (net.IP, error) {
+	if !c.isTrusted(peer) {
+		return peer, nil
+	}
+
+	chain, err := c.chain(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("the request from the trusted hop %s has no %s header", peer, c.Header)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, err := parseRemoteAddr(chain[i])
+		if err != nil {
+			return nil, fmt.Errorf("the %s header contains an invalid address: %s", c.Header, err.Error())
+		}
+
+		if !c.isTrusted(ip) || i == 0 {
+			return ip, nil
+		}
+	}
+
+	return peer, nil
+}
+
+func (c *ClientIP) isTrusted(ip net.IP) bool {
+	for _, cidr := range c.trustedCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// chain returns the addresses from the configured header, from the farthest hop to the nearest one.
+func (c *ClientIP) chain(header http.Header) ([]string, error) {
+	var chain []string
+
+	for _, value := range header.Values(c.Header) {
+		for _, element := range strings.Split(value, ",") {
+			element = strings.TrimSpace(element)
+
+			if element == "" {
+				continue
+			}
+
+			if c.Header != HeaderForwarded {
+				chain = append(chain, element)
+				continue
+			}
+
+			node, ok, err := parseForwardedElement(element)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				chain = append(chain, node)
+			}
+		}
+	}
+
+	return chain, nil
+}
+
+// parseForwardedElement returns the "for" parameter of the RFC 7239 Forwarded header element.
+// Unknown (for=unknown) and obfuscated (for=_hidden) identifiers can't be checked, so they are reported as errors.
+func parseForwardedElement(element string) (string, bool, error) {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(key), "for") {
+			continue
+		}
+
+		value = strings.Trim(strings.TrimSpace(value), "\"")
+
+		if value == "" || strings.EqualFold(value, "unknown") || strings.HasPrefix(value, "_") {
+			return "", false, fmt.Errorf("the Forwarded header contains an unidentified node %q", value)
+		}
+
+		return value, true, nil
+	}
+
+	return "", false, nil
+}
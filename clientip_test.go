@@ -0,0 +1,230 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRemoteAddr(t *testing.T) {
+	t.Log("Given the need to check the parsing of every form of the client address.")
+	{
+		tests := []struct {
+			remoteAddr string
+			expected   string
+		}{
+			{"192.0.2.1:8080", "192.0.2.1"},
+			{"192.0.2.1", "192.0.2.1"},
+			{"[2001:db8::1]:443", "2001:db8::1"},
+			{"[2001:db8::1]", "2001:db8::1"},
+			{"2001:db8::1", "2001:db8::1"},
+			{"[::1]:80", "::1"},
+			{"[::ffff:192.0.2.1]:80", "192.0.2.1"},
+			{"::ffff:192.0.2.1", "192.0.2.1"},
+			{"[fe80::1%eth0]:80", "fe80::1"},
+			{"fe80::1%eth0", "fe80::1"},
+			{"[fe80::1%25eth0]", "fe80::1"},
+			{"", ""},
+			{":80", ""},
+			{"not-an-ip:80", ""},
+			{"192.0.2.256:80", ""},
+			{"[192.0.2.1:80", ""},
+		}
+
+		for testId, test := range tests {
+			ip, err := parseRemoteAddr(test.remoteAddr)
+
+			if test.expected == "" {
+				t.Logf("\tTest %d: Whether the address %q is rejected.", testId, test.remoteAddr)
+				require.Errorf(t, err, "The address %q should be rejected.", test.remoteAddr)
+				continue
+			}
+
+			t.Logf("\tTest %d: Whether the address %q is parsed as %s.", testId, test.remoteAddr, test.expected)
+			require.NoErrorf(t, err, "The address %q should be accepted.", test.remoteAddr)
+			require.Truef(t, net.ParseIP(test.expected).Equal(ip), "The address %q should be parsed as %s, got %s.", test.remoteAddr, test.expected, ip)
+		}
+	}
+
+	t.Log("Given the need to check the parsing of subnets.")
+	{
+		tests := []struct {
+			cidr     string
+			expected string
+		}{
+			{"192.0.2.1", "192.0.2.1/32"},
+			{"192.0.2.0/24", "192.0.2.0/24"},
+			{"2001:db8::1", "2001:db8::1/128"},
+			{"2001:db8::/32", "2001:db8::/32"},
+			{"::ffff:192.0.2.1", "192.0.2.1/32"},
+			{" 192.0.2.0/24 ", "192.0.2.0/24"},
+		}
+
+		for testId, test := range tests {
+			cidr, err := parseCIDR(test.cidr)
+
+			t.Logf("\tTest %d: Whether the subnet %q is parsed as %s.", testId, test.cidr, test.expected)
+			require.NoErrorf(t, err, "The subnet %q should be accepted.", test.cidr)
+			require.Equalf(t, test.expected, cidr.String(), "The subnet %q should be parsed as %s.", test.cidr, test.expected)
+		}
+	}
+}
+
+func TestServeHTTPAddressForms(t *testing.T) {
+	items := make(map[string]*ReverseProxy, 1)
+	items["partner"] = &ReverseProxy{
+		RawStaticCIDRs: []string{"192.0.2.0/24", "2001:db8::/32", "fe80::/10"},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), &Config{Map: items}, "ReverseGuard")
+	require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+	t.Log("Given the need to check that the requests are allowed or forbidden regardless of the client address form.")
+	{
+		tests := []struct {
+			remoteAddr string
+			code       int
+		}{
+			{"192.0.2.1:8080", http.StatusOK},
+			{"192.0.2.1", http.StatusOK},
+			{"[2001:db8::1]:443", http.StatusOK},
+			{"[::ffff:192.0.2.1]:443", http.StatusOK},
+			{"[fe80::1%eth0]:443", http.StatusOK},
+			{"198.51.100.1:8080", http.StatusForbidden},
+			{"[2001:db9::1]:443", http.StatusForbidden},
+			{"garbage", http.StatusForbidden},
+			{"", http.StatusForbidden},
+		}
+
+		for testId, test := range tests {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = test.remoteAddr
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			t.Logf("\tTest %d: Whether the request from %q gets the %d code.", testId, test.remoteAddr, test.code)
+			require.Equalf(t, test.code, rec.Code, "The request from %q should get the %d code.", test.remoteAddr, test.code)
+		}
+	}
+}
+
+func TestClientIPResolution(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check the configuration errors of the client_ip section.")
+	{
+		items := map[string]*ReverseProxy{"partner": {RawStaticCIDRs: []string{"192.0.2.0/24"}}}
+
+		_, err := New(context.Background(), next, &Config{Map: items, ClientIP: &ClientIP{}}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an error occurs if no trusted hops are configured.", testId)
+		require.ErrorContainsf(t, err, "no trusted hops", "An error message should contain information about the missing trusted hops.")
+
+		testId++
+
+		_, err = New(context.Background(), next, &Config{Map: items, ClientIP: &ClientIP{RawTrustedCIDRs: []string{"10.0.0.0/33"}}}, "ReverseGuard")
+
+		t.Logf("\tTest %d: Whether an error occurs if a trusted hop is invalid.", testId)
+		require.ErrorContainsf(t, err, "\"10.0.0.0/33\" is invalid", "An error message should contain information about the invalid trusted hop.")
+	}
+
+	t.Log("Given the need to check the resolution of the real client IP.")
+	{
+		tests := []struct {
+			header   string
+			values   []string
+			peer     string
+			expected string
+		}{
+			// the peer is not a trusted hop, so the header is ignored
+			{HeaderXForwardedFor, []string{"192.0.2.1"}, "203.0.113.1", "203.0.113.1"},
+			// no header
+			{HeaderXForwardedFor, nil, "10.0.0.1", ""},
+			{HeaderXForwardedFor, []string{""}, "10.0.0.1", ""},
+			{HeaderXForwardedFor, []string{" , "}, "10.0.0.1", ""},
+			{HeaderForwarded, []string{"proto=https"}, "10.0.0.1", ""},
+			{HeaderXForwardedFor, []string{"192.0.2.1"}, "10.0.0.1", "192.0.2.1"},
+			{HeaderXForwardedFor, []string{"198.51.100.1, 192.0.2.1, 10.0.0.2"}, "10.0.0.1", "192.0.2.1"},
+			{HeaderXForwardedFor, []string{"198.51.100.1", "192.0.2.1, 10.0.0.2"}, "10.0.0.1", "192.0.2.1"},
+			// all the hops are trusted
+			{HeaderXForwardedFor, []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.1", "10.0.0.3"},
+			{HeaderXForwardedFor, []string{"2001:db8::1, 10.0.0.2"}, "10.0.0.1", "2001:db8::1"},
+			{HeaderXForwardedFor, []string{"garbage, 10.0.0.2"}, "10.0.0.1", ""},
+			{HeaderForwarded, []string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, "10.0.0.1", "192.0.2.60"},
+			{HeaderForwarded, []string{`for=198.51.100.1, For="[2001:db8:cafe::17]:4711"`}, "10.0.0.1", "2001:db8:cafe::17"},
+			{HeaderForwarded, []string{"for=192.0.2.60:8080, for=10.0.0.2"}, "10.0.0.1", "192.0.2.60"},
+			{HeaderForwarded, []string{"for=unknown, for=10.0.0.2"}, "10.0.0.1", ""},
+			{HeaderForwarded, []string{"for=_hidden"}, "10.0.0.1", ""},
+			{"Cf-Connecting-Ip", []string{"192.0.2.1"}, "10.0.0.1", "192.0.2.1"},
+		}
+
+		for testId, test := range tests {
+			clientIP := &ClientIP{
+				Header:       test.header,
+				trustedCIDRs: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")},
+			}
+
+			header := http.Header{}
+			for _, v := range test.values {
+				header.Add(test.header, v)
+			}
+
+			ip, err := clientIP.resolve(net.ParseIP(test.peer), header)
+
+			if test.expected == "" {
+				t.Logf("\tTest %d: Whether the %s header %q is rejected.", testId, test.header, test.values)
+				require.Errorf(t, err, "The %s header %q should be rejected.", test.header, test.values)
+				continue
+			}
+
+			t.Logf("\tTest %d: Whether the client IP is resolved as %s from the %s header %q and the peer %s.", testId, test.expected, test.header, test.values, test.peer)
+			require.NoErrorf(t, err, "The %s header %q should be accepted.", test.header, test.values)
+			require.Truef(t, net.ParseIP(test.expected).Equal(ip), "The client IP should be %s, got %s.", test.expected, ip)
+		}
+	}
+
+	t.Log("Given the need to check that the resolved client IP is evaluated against the guards.")
+	{
+		// the trusted hops are trusted by the guard as well, so only the resolution keeps their requests out
+		items := map[string]*ReverseProxy{"partner": {RawStaticCIDRs: []string{"192.0.2.0/24", "10.0.0.0/8"}}}
+		cfg := &Config{
+			Map:      items,
+			ClientIP: &ClientIP{Header: "x-forwarded-for", RawTrustedCIDRs: []string{"10.0.0.0/8"}},
+		}
+
+		handler, err := New(context.Background(), next, cfg, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		tests := []struct {
+			remoteAddr string
+			xff        string
+			code       int
+		}{
+			{"10.0.0.1:1234", "192.0.2.1", http.StatusOK},
+			{"10.0.0.1:1234", "198.51.100.1", http.StatusForbidden},
+			{"10.0.0.1:1234", "192.0.2.1, 198.51.100.1", http.StatusForbidden},
+			{"10.0.0.1:1234", "", http.StatusForbidden},
+			{"192.0.2.1:1234", "198.51.100.1", http.StatusOK},
+		}
+
+		for testId, test := range tests {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.xff != "" {
+				req.Header.Set(HeaderXForwardedFor, test.xff)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			t.Logf("\tTest %d: Whether the request from %q with X-Forwarded-For %q gets the %d code.", testId, test.remoteAddr, test.xff, test.code)
+			require.Equalf(t, test.code, rec.Code, "The request should get the %d code.", test.code)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package reverseguard
 
 import (
-	"bufio"
-	"errors"
+	"crypto/ed25519"
 	"fmt"
-	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -21,6 +25,22 @@ const (
 	ActionRename = "rename"
 	ActionDelete = "delete"
 	ActionCopy   = "copy"
+
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+
+	MatchPriority      = "priority"
+	MatchLongestPrefix = "longest_prefix"
+
+	FormatText = "text"
+	FormatJSON = "json"
+
+	InvalidEntryFail = "fail"
+	InvalidEntrySkip = "skip"
+	InvalidEntryWarn = "warn"
+
+	ExpiryDrop = "drop"
+	ExpiryDeny = "deny"
 )
 
 type HeaderAction struct {
@@ -34,21 +54,114 @@ type ForbiddenResponse struct {
 	content string `mapstructure:"content,omitempty"`
 }
 
+type ClientIP struct {
+	Header          string   `mapstructure:"header,omitempty"`
+	RawTrustedCIDRs []string `mapstructure:"trusted_cidrs,omitempty"`
+	trustedCIDRs    []*net.IPNet
+}
+
+// Admin configures the admin endpoint served by the middleware itself. It is only available to the clients
+// from the allowed subnets presenting the token.
+type Admin struct {
+	Path string `mapstructure:"path"`
+	// Token is expected in the "Authorization: Bearer" header. The "env:NAME" and "file:/path" values
+	// are resolved on every request.
+	Token           string   `mapstructure:"token"`
+	RawAllowedCIDRs []string `mapstructure:"allowed_cidrs"`
+	allowedCIDRs    []*net.IPNet
+}
+
 type Config struct {
-	Custom403Response *ForbiddenResponse       `mapstructure:"rewrite_403,omitempty"`
+	Custom403Response *ForbiddenResponse `mapstructure:"rewrite_403,omitempty"`
+	ClientIP          *ClientIP          `mapstructure:"client_ip,omitempty"`
+	Admin             *Admin             `mapstructure:"admin,omitempty"`
+	MatchStrategy     string             `mapstructure:"match_strategy,omitempty"`
+	CacheDir          string             `mapstructure:"cache_dir,omitempty"`
+	RawCacheMaxAge    string             `mapstructure:"cache_max_age,omitempty"`
+	cacheMaxAge       time.Duration
 	Map               map[string]*ReverseProxy `mapstructure:"map,omitempty"`
 }
 
-type Interval struct {
-	Number int
-	Unit   string
+// Interval is the period of syncing a dynamic subnet list.
+type Interval time.Duration
+
+// intervalUnits are the units of the Go duration syntax along with the days and the weeks.
+var intervalUnits = map[string]time.Duration{
+	"ns":   time.Nanosecond,
+	"us":   time.Microsecond,
+	"µs":   time.Microsecond,
+	"ms":   time.Millisecond,
+	Second: time.Second,
+	Minute: time.Minute,
+	Hour:   time.Hour,
+	Day:    24 * time.Hour,
+	Week:   7 * 24 * time.Hour,
+}
+
+var intervalToken = regexp.MustCompile(`(\d+(?:\.\d*)?|\.\d+)([^\d.]+)`)
+
+// Retry configures the repeated attempts of a failed dynamic list refresh. The delay between the attempts
+// starts at InitialBackoff and doubles up to MaxBackoff. Every delay is randomized by the Jitter fraction.
+type Retry struct {
+	MaxAttempts       int    `mapstructure:"max_attempts,omitempty"`
+	RawInitialBackoff string `mapstructure:"initial_backoff,omitempty"`
+	initialBackoff    time.Duration
+	RawMaxBackoff     string `mapstructure:"max_backoff,omitempty"`
+	maxBackoff        time.Duration
+	Jitter            float64 `mapstructure:"jitter,omitempty"`
+}
+
+// Safeguards protect against a truncated or poisoned list: a refresh violating any of them is rejected
+// and the previous list is kept. Zero values disable the corresponding checks.
+type Safeguards struct {
+	MinEntries int `mapstructure:"min_entries,omitempty"`
+	MaxEntries int `mapstructure:"max_entries,omitempty"`
+	// MaxChangeRatio limits the number of the added and removed subnets relative to the size of the previous list.
+	MaxChangeRatio float64 `mapstructure:"max_change_ratio,omitempty"`
+	// MinPrefixV4 and MinPrefixV6 reject the subnets broader than the given prefix length, e.g. 8 rejects 0.0.0.0/0.
+	MinPrefixV4 int `mapstructure:"min_prefix_v4,omitempty"`
+	MinPrefixV6 int `mapstructure:"min_prefix_v6,omitempty"`
+	// RejectReserved rejects the subnets overlapping the loopback, link-local, multicast and other special ranges.
+	RejectReserved bool     `mapstructure:"reject_reserved,omitempty"`
+	RawRejectCIDRs []string `mapstructure:"reject_cidrs,omitempty"`
+	rejectCIDRs    []*net.IPNet
+}
+
+// Verify configures the authenticity check of the changed list, performed before the list is accepted.
+// The list is verified by the detached Ed25519 signature, by the pinned SHA-256 digest, or by both.
+type Verify struct {
+	// PublicKey is the base64-encoded Ed25519 public key.
+	PublicKey string `mapstructure:"public_key,omitempty"`
+	// SignatureUrl is the url of the signature of a remote list, <url>.sig by default (the suffix is added to the path).
+	// The signature of a file is always read from the <file>.sig file next to it.
+	SignatureUrl string `mapstructure:"signature_url,omitempty"`
+	// SHA256 is the hex-encoded digest of the list.
+	SHA256    string `mapstructure:"sha256,omitempty"`
+	publicKey ed25519.PublicKey
+	digest    []byte
+}
+
+// SourceTLS configures the TLS connections to a remote source: the private CA, the client certificate for mTLS
+// and the expected server name.
+type SourceTLS struct {
+	CAFile     string `mapstructure:"ca_file,omitempty"`
+	CertFile   string `mapstructure:"cert_file,omitempty"`
+	KeyFile    string `mapstructure:"key_file,omitempty"`
+	ServerName string `mapstructure:"server_name,omitempty"`
 }
 
 type ReverseProxy struct {
-	HeaderActions  []*HeaderAction `mapstructure:"header_actions,omitempty"`
-	RawStaticCIDRs []string        `mapstructure:"static_cidrs,omitempty"`
-	staticCIDRS    []*net.IPNet
-	DynamicCIDRs   []*DynamicCIDR `mapstructure:"dynamic_cidrs,omitempty"`
+	name               string
+	Priority           int             `mapstructure:"priority,omitempty"`
+	HeaderActions      []*HeaderAction `mapstructure:"header_actions,omitempty"`
+	RawStaticCIDRs     []string        `mapstructure:"static_cidrs,omitempty"`
+	staticCIDRS        []*net.IPNet
+	DynamicCIDRs       []*DynamicCIDR `mapstructure:"dynamic_cidrs,omitempty"`
+	RawDenyStaticCIDRs []string       `mapstructure:"deny_static_cidrs,omitempty"`
+	denyStaticCIDRs    []*net.IPNet
+	DenyDynamicCIDRs   []*DynamicCIDR `mapstructure:"deny_dynamic_cidrs,omitempty"`
+	// Preset adds the sources, the static subnets and the header actions of a known provider.
+	Preset string `mapstructure:"preset,omitempty"`
 }
 
 func (r *ReverseProxy) applyHeaderOptions(req *http.Request) {
@@ -71,54 +184,168 @@ func (r *ReverseProxy) applyHeaderOptions(req *http.Request) {
 	}
 }
 
-func (r *ReverseProxy) contains(ip net.IP) bool {
-	for _, trustedCIDR := range r.staticCIDRS {
-		if trustedCIDR.Contains(ip) {
-			return true
-		}
-	}
+func (r *ReverseProxy) countCIDRs() int {
+	num := len(r.staticCIDRS)
 
-	for _, trustedCIDRList := range r.DynamicCIDRs {
-		for _, trustedCIDR := range trustedCIDRList.cidrList {
-			if trustedCIDR.Contains(ip) {
-				return true
+	for _, v := range r.DynamicCIDRs {
+		for _, entry := range v.cidrs() {
+			if !entry.denied {
+				num++
 			}
 		}
 	}
 
-	return false
+	return num
 }
 
-func (r *ReverseProxy) countCIDRs() int {
-	num := len(r.staticCIDRS)
+// countDenyCIDRs counts the denied subnets, including the expired ones of the trusted lists.
+func (r *ReverseProxy) countDenyCIDRs() int {
+	num := len(r.denyStaticCIDRs)
+
+	for _, v := range r.DenyDynamicCIDRs {
+		num += len(v.cidrs())
+	}
 
 	for _, v := range r.DynamicCIDRs {
-		num += len(v.cidrList)
+		for _, entry := range v.cidrs() {
+			if entry.denied {
+				num++
+			}
+		}
 	}
 
 	return num
 }
 
+// NewInterval returns the interval of the number of the units, e.g. 5 and m. The bounds of ParseInterval apply.
 func NewInterval(number int, unit string) (*Interval, error) {
 	if number <= 0 {
 		return nil, fmt.Errorf("the interval \"%v%q\" is invalid because the number must be greater than zero", number, unit)
 	}
 
-	if unit != Second && unit != Minute && unit != Hour && unit != Day && unit != Week {
-		return nil, fmt.Errorf("the interval \"%v%q\" is invalid because the unit is unknown. Available units: s, m, h, d, w", number, unit)
+	return ParseInterval(fmt.Sprintf("%d%s", number, unit))
+}
+
+// ParseInterval parses the interval in the Go duration syntax (e.g. 1h30m), extended by the d (24h) and w (7d) units,
+// e.g. 1w or 1d12h.
+func ParseInterval(value string) (*Interval, error) {
+	tokens := intervalToken.FindAllStringSubmatch(value, -1)
+
+	var parsed []string
+	var total float64
+
+	for _, token := range tokens {
+		parsed = append(parsed, token[0])
+
+		number, err := strconv.ParseFloat(token[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("the interval %q is invalid", value)
+		}
+
+		unit, ok := intervalUnits[token[2]]
+		if !ok {
+			return nil, fmt.Errorf("the interval %q is invalid because the unit %q is unknown. Available units: ns, us, ms, s, m, h, d, w", value, token[2])
+		}
+
+		total += number * float64(unit)
+	}
+
+	if len(tokens) == 0 || strings.Join(parsed, "") != value {
+		return nil, fmt.Errorf("the interval %q is invalid", value)
+	}
+
+	if total < float64(time.Second) || total > float64(math.MaxInt64) {
+		return nil, fmt.Errorf("the interval %q is invalid because it must be between 1s and %s", value, time.Duration(math.MaxInt64))
 	}
 
-	return &Interval{
-		Number: number,
-		Unit:   unit,
-	}, nil
+	interval := Interval(total)
+
+	return &interval, nil
+}
+
+// Duration converts the interval to time.Duration.
+func (i Interval) Duration() time.Duration {
+	return time.Duration(i)
 }
 
 type DynamicCIDR struct {
 	Url         string `mapstructure:"url"`
 	interval    *Interval
-	RawInterval string `mapstructure:"interval,omitempty"`
-	cidrList    []*net.IPNet
+	RawInterval string            `mapstructure:"interval,omitempty"`
+	Format      string            `mapstructure:"format,omitempty"`
+	JSONPaths   []string          `mapstructure:"json_paths,omitempty"`
+	JSONFilter  map[string]string `mapstructure:"json_filter,omitempty"`
+	MaxBytes    int64             `mapstructure:"max_bytes,omitempty"`
+	RawTimeout  string            `mapstructure:"timeout,omitempty"`
+	timeout     time.Duration
+	UserAgent   string `mapstructure:"user_agent,omitempty"`
+	// Headers are sent with every request. The "env:NAME" and "file:/path" values are resolved on every request.
+	Headers map[string]string `mapstructure:"headers,omitempty"`
+	TLS     *SourceTLS        `mapstructure:"tls,omitempty"`
+	// DNSResolver is the address (host:port) of the DNS server queried by a dns source instead of the system one.
+	DNSResolver string `mapstructure:"dns_resolver,omitempty"`
+	// DNSMaxDepth limits the nesting of the includes expanded by a dns source.
+	DNSMaxDepth int `mapstructure:"dns_max_depth,omitempty"`
+	// Schedule is the cron expression of the refreshes (in UTC), an alternative to the interval.
+	Schedule string `mapstructure:"schedule,omitempty"`
+	schedule *cronSchedule
+	// IntervalJitter randomizes every interval by the given fraction, e.g. 0.1 means ±10%.
+	IntervalJitter float64     `mapstructure:"interval_jitter,omitempty"`
+	Retry          *Retry      `mapstructure:"retry,omitempty"`
+	Safeguards     *Safeguards `mapstructure:"safeguards,omitempty"`
+	Verify         *Verify     `mapstructure:"verify,omitempty"`
+	// OnInvalidEntry is the policy for the invalid entries: reject the whole update, or skip them
+	// with a summary (skip) or with an error per entry (warn) as long as MinValidRatio of the entries are valid.
+	// An explicit zero accepts any share of the valid entries, so MinValidRatio is nil unless it is set.
+	OnInvalidEntry string   `mapstructure:"on_invalid_entry,omitempty"`
+	MinValidRatio  *float64 `mapstructure:"min_valid_ratio,omitempty"`
+	minValidRatio  float64
+	// RawWatchInterval is the period of checking a file source for changes.
+	RawWatchInterval string `mapstructure:"watch_interval,omitempty"`
+	watchInterval    time.Duration
+	// RawMaxStaleness is the age of the last successful refresh after which all the entries of the source expire.
+	RawMaxStaleness string `mapstructure:"max_staleness,omitempty"`
+	maxStaleness    time.Duration
+	// OnExpiry is what happens to the expired entries: they are dropped, or denied by the guard.
+	OnExpiry string       `mapstructure:"on_expiry,omitempty"`
+	cidrList atomic.Value // []*net.IPNet, replaced as a whole on every update
+	mu       sync.Mutex   // serializes the updates
+
+	// the HTTP cache validators of the last accepted response
+	etag         string
+	lastModified string
+
+	// the state of the files of the file source as of the last accepted read
+	fileInfos map[string]os.FileInfo
+
+	// the time of the last successful refresh, including the not modified ones
+	refreshedAt time.Time
+
+	// the last-known-good persistence, disabled if cacheDir is empty
+	cacheDir    string
+	cacheMaxAge time.Duration
+
+	// the list embedded in the preset, used if neither the source nor the cache is available at start
+	snapshot string
+}
+
+// cidrEntry is a subnet of a dynamic list along with its origin: the file it was read from or the url.
+type cidrEntry struct {
+	cidr    *net.IPNet
+	origin  string
+	expires time.Time // zero if the entry never expires
+	denied  bool      // the entry has expired and is denied by the guard
+}
+
+// cidrs returns the current snapshot of the subnet list. The snapshot is never modified.
+func (d *DynamicCIDR) cidrs() []cidrEntry {
+	list, _ := d.cidrList.Load().([]cidrEntry)
+
+	return list
+}
+
+func (d *DynamicCIDR) setCIDRs(list []cidrEntry) {
+	d.cidrList.Store(list)
 }
 
 func (d *DynamicCIDR) isFileUrl() bool {
@@ -129,130 +356,282 @@ func (d *DynamicCIDR) isHttpUrl() bool {
 	return strings.HasPrefix(d.Url, "http://") || strings.HasPrefix(d.Url, "https://")
 }
 
-func (d *DynamicCIDR) hasCIDR(cidr string) bool {
-	if !strings.Contains(cidr, "/") {
-		cidr += "/32"
+// readResult is the raw content of the subnet list along with the HTTP cache validators.
+type readResult struct {
+	documents    []sourceDocument
+	notModified  bool
+	etag         string
+	lastModified string
+	fileInfos    map[string]os.FileInfo
+}
+
+// sourceDocument is the content of a single file of the source, or the response body of a remote source.
+type sourceDocument struct {
+	origin  string
+	content []byte
+}
+
+// updateResult describes the outcome of the subnet list update.
+type updateResult struct {
+	total     int
+	skipped   int
+	invalid   int
+	expired   int
+	added     int // the subnets which were not in the previous list
+	removed   int // the subnets of the previous list which are gone
+	unchanged bool
+	origins   []string // the number of subnets per file of a directory or glob source, or per domain of a dns source
+}
+
+// summary returns the number of subnets per origin of a source consisting of several documents
+// to be appended to the logs.
+func (r *updateResult) summary() string {
+	if len(r.origins) == 0 {
+		return ""
 	}
 
-	for _, v := range d.cidrList {
-		item := v.String()
+	return ". Origins: " + strings.Join(r.origins, ", ")
+}
 
-		if !strings.Contains(item, "/") {
-			item += "/32"
-		}
+// read loads the raw content of the subnet list.
+func (d *DynamicCIDR) read() (*readResult, error) {
+	if d.isFileUrl() {
+		return d.readFiles()
+	}
 
-		if cidr == item {
-			return true
-		}
+	if d.isHttpUrl() {
+		return d.fetchHTTP()
 	}
 
-	return false
+	if d.isDnsUrl() {
+		return d.readDNS()
+	}
+
+	return nil, fmt.Errorf("the url %q is not supported. Available schemes: file, http, https, dns", d.Url)
 }
 
-func (d *DynamicCIDR) update() (int, int, error) {
-	var added int = 0
-	var skipped int = 0
+func (d *DynamicCIDR) update() (*updateResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if d.isFileUrl() {
-		filePath := d.Url[7:len(d.Url)]
+	result := &updateResult{}
+	previous := d.cidrs()
 
-		_, err := os.Stat(filePath)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return 0, 0, fmt.Errorf("the file %q does not exist", filePath)
-			}
-			if errors.Is(err, os.ErrPermission) {
-				return 0, 0, fmt.Errorf("no permissions to read the file %q", filePath)
-			}
+	read, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if read.notModified {
+		result.total = len(d.cidrs())
+		result.unchanged = true
+
+		// the unchanged files are as old as they were
+		if !d.isFileUrl() {
+			d.refreshedAt = time.Now()
 		}
 
-		// open the file
-		file, err := os.Open(filePath)
-		if err != nil {
-			return 0, 0, err
+		// refresh the fetch time of the cached list. Files are watched too often to be persisted when unchanged.
+		if !d.isFileUrl() {
+			d.persist()
 		}
 
-		defer file.Close()
+		return result, nil
+	}
 
-		fileScanner := bufio.NewScanner(file)
+	if d.Verify != nil {
+		if err := d.verifyDocuments(read.documents); err != nil {
+			return nil, err
+		}
+	}
 
-		var CIDRList []*net.IPNet
+	seen := make(map[string]bool)
 
-		for fileScanner.Scan() {
-			entry := fileScanner.Text()
+	var CIDRList []cidrEntry
 
-			if !strings.Contains(entry, "/") {
-				entry += "/32"
+	// the subnets found in several documents are attributed to the first of them
+	add := func(entry cidrEntry) {
+		if seen[entry.cidr.String()] {
+			result.skipped++
+			return
+		}
+
+		seen[entry.cidr.String()] = true
+		result.total++
+		CIDRList = append(CIDRList, entry)
+	}
+
+	var valid int
+	var invalid []string
+
+	for _, document := range read.documents {
+		content := document.content
+
+		var errs []*listError
+
+		if d.Format == FormatJSON {
+			entries, err := extractJSON(content, d.JSONPaths, d.JSONFilter)
+			if err != nil {
+				return nil, d.documentError(document, err)
 			}
 
-			if d.hasCIDR(entry) {
-				skipped++
-				continue
+			for _, v := range entries {
+				cidr, err := parseCIDR(v)
+				if err != nil {
+					errs = append(errs, &listError{message: fmt.Sprintf("the JSON document contains an invalid CIDR %q", v)})
+					continue
+				}
+
+				valid++
+				add(cidrEntry{cidr: cidr, origin: document.origin})
 			}
+		} else {
+			entries, validLines, listErrs := parseTextList(content)
 
-			_, cidr, err := net.ParseCIDR(entry)
-			if err != nil {
-				return 0, 0, err
+			for _, v := range entries {
+				add(cidrEntry{cidr: v.cidr, origin: document.origin, expires: v.expires})
 			}
 
-			added++
-			CIDRList = append(d.cidrList, cidr)
+			valid += validLines
+			errs = listErrs
 		}
 
-		d.cidrList = CIDRList // not replace
-	} else if d.isHttpUrl() {
-		resp, err := http.Get(d.Url)
-		if err != nil {
-			return 0, 0, err
+		for _, v := range errs {
+			if d.OnInvalidEntry != InvalidEntrySkip && d.OnInvalidEntry != InvalidEntryWarn {
+				return nil, d.documentError(document, v)
+			}
+
+			invalid = append(invalid, d.documentError(document, v).Error())
 		}
+	}
 
-		if resp.StatusCode != 304 && resp.StatusCode != 200 {
-			return 0, 0, fmt.Errorf("response code %d is not acceptable", resp.StatusCode)
+	if len(invalid) > 0 {
+		if ratio := float64(valid) / float64(valid+len(invalid)); ratio < d.minValidRatio {
+			return nil, fmt.Errorf(
+				"only %d of %d entries are valid, which is below the min_valid_ratio of %g. The first invalid one: %s",
+				valid,
+				valid+len(invalid),
+				d.minValidRatio,
+				invalid[0],
+			)
 		}
 
-		r := http.MaxBytesReader(nil, resp.Body, 2000)
-		buff, err := io.ReadAll(r)
-		if err != nil {
-			return 0, 0, err
+		result.invalid = len(invalid)
+		d.reportInvalid(invalid)
+	}
+
+	if d.Safeguards != nil {
+		if err := d.Safeguards.check(CIDRList, d.cidrs()); err != nil {
+			return nil, fmt.Errorf("the list is rejected by the safeguards: %s", err.Error())
 		}
+	}
 
-		defer resp.Body.Close()
+	now := time.Now()
 
-		replacer := strings.NewReplacer("\r\n", "\n", "\r", "\n", "\v", "\n", "\f", "\n")
-		content := replacer.Replace(string(buff))
+	d.refreshedAt = now
+	if d.isFileUrl() {
+		d.refreshedAt = newestModTime(read.fileInfos)
+	}
 
-		var CIDRList []*net.IPNet
+	// the entries which have already expired are not published
+	CIDRList, result.expired = d.applyExpiry(CIDRList, now)
+	if result.expired > 0 {
+		result.total = len(CIDRList)
+	}
 
-		for _, v := range strings.Split(content, "\n") {
-			v = strings.TrimSpace(v)
+	d.setCIDRs(CIDRList) // hot replace
 
-			if v == "" {
-				continue
-			}
+	result.added, result.removed = diffCIDRs(previous, CIDRList)
 
-			if !strings.Contains(v, "/") {
-				v += "/32"
-			}
+	if len(read.documents) > 1 || d.isFileUrl() && len(read.documents) == 1 && read.documents[0].origin != d.Url[7:len(d.Url)] {
+		counts := make(map[string]int, len(read.documents))
+		for _, v := range CIDRList {
+			counts[v.origin]++
+		}
 
-			if d.hasCIDR(v) {
-				skipped++
-				continue
-			}
+		for _, document := range read.documents {
+			result.origins = append(result.origins, fmt.Sprintf("%s (%d)", document.origin, counts[document.origin]))
+		}
+	}
 
-			_, cidr, err := net.ParseCIDR(v)
-			if err != nil {
-				d.cidrList = nil
-				return 0, 0, errors.New("invalid URL content")
-			}
+	// the validators are remembered only once the content is accepted
+	d.etag = read.etag
+	d.lastModified = read.lastModified
+	d.fileInfos = read.fileInfos
+
+	d.persist()
+
+	return result, nil
+}
+
+// diffCIDRs counts the subnets added to the list and removed from it.
+func diffCIDRs(previous, current []cidrEntry) (int, int) {
+	before := make(map[string]bool, len(previous))
+	for _, v := range previous {
+		before[v.cidr.String()] = true
+	}
 
-			added++
-			CIDRList = append(CIDRList, cidr)
+	var added int
+
+	for _, v := range current {
+		if before[v.cidr.String()] {
+			delete(before, v.cidr.String())
+			continue
+		}
+
+		added++
+	}
+
+	return added, len(before)
+}
+
+// reportInvalid logs the skipped invalid entries: every one of them in the warn mode, or the summary of the first
+// ones in the skip mode.
+func (d *DynamicCIDR) reportInvalid(invalid []string) {
+	if d.OnInvalidEntry == InvalidEntryWarn {
+		for _, v := range invalid {
+			writeErr(fmt.Sprintf("Endpoint %q, the invalid entry is skipped: %s", d.Url, v))
 		}
 
-		d.cidrList = CIDRList // hot replace
-	} else {
-		panic("not implemented")
+		return
 	}
 
-	return added, skipped, nil
+	const maxReported = 10
+
+	summary := invalid
+	if len(summary) > maxReported {
+		summary = summary[:maxReported]
+	}
+
+	message := fmt.Sprintf("Endpoint %q, %d invalid entries are skipped: %s", d.Url, len(invalid), strings.Join(summary, "; "))
+	if len(invalid) > maxReported {
+		message += fmt.Sprintf("; and %d more", len(invalid)-maxReported)
+	}
+
+	writeOut(message)
+}
+
+// documentError prefixes the error with the file or the domain it occurred in. An HTTP source consists
+// of a single document, so its errors are returned as is. Either way, the previous list is kept.
+func (d *DynamicCIDR) documentError(document sourceDocument, err error) error {
+	if d.isFileUrl() {
+		return fmt.Errorf("the file %q: %s", document.origin, err.Error())
+	}
+
+	if d.isDnsUrl() {
+		return fmt.Errorf("the domain %q: %s", document.origin, err.Error())
+	}
+
+	return err
+}
+
+// persist saves the current subnet list to the cache directory, if it is configured.
+func (d *DynamicCIDR) persist() {
+	if d.cacheDir == "" {
+		return
+	}
+
+	if err := d.saveCache(); err != nil {
+		writeErr(fmt.Sprintf("Endpoint %q, failed to save the subnet list to the cache directory %q: %s", d.Url, d.cacheDir, err.Error()))
+	}
 }
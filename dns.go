@@ -0,0 +1,245 @@
+package reverseguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DNSRecordA   = "a"
+	DNSRecordTXT = "txt"
+
+	defaultDNSMaxDepth = 10
+)
+
+func (d *DynamicCIDR) isDnsUrl() bool {
+	return strings.HasPrefix(d.Url, "dns://")
+}
+
+// dnsQuery parses the dns:// url: dns://<domain>?type=a resolves the A and AAAA records of the domain,
+// dns://<domain>?type=txt expands its SPF-style TXT records.
+func (d *DynamicCIDR) dnsQuery() (string, string, error) {
+	u, err := url.Parse(d.Url)
+	if err != nil {
+		return "", "", err
+	}
+
+	domain := strings.TrimSuffix(u.Hostname(), ".")
+	if domain == "" {
+		return "", "", errors.New("the dns url requires a domain, e.g. dns://partner.example.com?type=txt")
+	}
+
+	recordType := strings.ToLower(u.Query().Get("type"))
+
+	switch recordType {
+	case "":
+		recordType = DNSRecordA
+	case DNSRecordA, DNSRecordTXT:
+		// nop
+	default:
+		return "", "", fmt.Errorf("the dns record type %q is not supported. Available types: %s, %s", recordType, DNSRecordA, DNSRecordTXT)
+	}
+
+	return domain, recordType, nil
+}
+
+// resolver returns the resolver of the source: the system one, or the one querying the configured server.
+func (d *DynamicCIDR) resolver() *net.Resolver {
+	if d.DNSResolver == "" {
+		return net.DefaultResolver
+	}
+
+	address := d.DNSResolver
+	dialer := &net.Dialer{}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// readDNS resolves the subnet list of the dns source. Every resolved domain becomes a separate document,
+// so the subnets are tagged with the domain they come from.
+func (d *DynamicCIDR) readDNS() (*readResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	domain, recordType, err := d.dnsQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	expander := &dnsExpander{
+		resolver: d.resolver(),
+		maxDepth: d.DNSMaxDepth,
+		visiting: make(map[string]bool),
+	}
+
+	if recordType == DNSRecordA {
+		lines, err := expander.lookupIP(ctx, domain, 8*net.IPv4len, 8*net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+
+		return &readResult{documents: []sourceDocument{{origin: domain, content: []byte(strings.Join(lines, "\n"))}}}, nil
+	}
+
+	if err := expander.expand(ctx, domain, 0); err != nil {
+		return nil, err
+	}
+
+	return &readResult{documents: expander.documents}, nil
+}
+
+// dnsExpander expands the SPF-style TXT records: the ip4: and ip6: terms are the subnets, the a and a:<domain>
+// terms are resolved to the addresses, widened by their optional prefix lengths (a/24, a:<domain>/24//64),
+// the include:<domain> terms and the redirect=<domain> modifiers are expanded
+// recursively. The terms with the fail, softfail and neutral qualifiers (-, ~, ?) and all the other terms are ignored.
+type dnsExpander struct {
+	resolver  *net.Resolver
+	maxDepth  int
+	visiting  map[string]bool
+	documents []sourceDocument
+}
+
+func (e *dnsExpander) expand(ctx context.Context, domain string, depth int) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if depth > e.maxDepth {
+		return fmt.Errorf("the include depth limit of %d is exceeded at %q", e.maxDepth, domain)
+	}
+
+	if e.visiting[domain] {
+		return fmt.Errorf("the include loop is detected at %q", domain)
+	}
+
+	e.visiting[domain] = true
+	defer delete(e.visiting, domain)
+
+	records, err := e.resolver.LookupTXT(ctx, domain+".")
+	if err != nil {
+		return fmt.Errorf("unable to resolve the TXT records of %q: %s", domain, err.Error())
+	}
+
+	var lines []string
+	var includes []string
+
+	for _, record := range records {
+		for _, term := range strings.Fields(record) {
+			if strings.HasPrefix(term, "+") {
+				term = term[1:]
+			} else if strings.ContainsAny(term[:1], "-~?") {
+				continue
+			}
+
+			name, value := term, ""
+			if i := strings.IndexAny(term, ":="); i >= 0 {
+				name, value = term[:i], term[i+1:]
+			}
+
+			mechanism := strings.ToLower(name)
+			if i := strings.Index(mechanism, "/"); i >= 0 {
+				mechanism = mechanism[:i]
+			}
+
+			switch mechanism {
+			case "ip4", "ip6":
+				lines = append(lines, value)
+			case "include", "redirect":
+				includes = append(includes, value)
+			case "a":
+				spec, lengths := term[1:], ""
+				if i := strings.Index(spec, "/"); i >= 0 {
+					spec, lengths = spec[:i], spec[i:]
+				}
+
+				target := strings.TrimPrefix(spec, ":")
+				if target == "" {
+					target = domain
+				}
+
+				ones4, ones6, err := parseDualCIDR(lengths)
+				if err != nil {
+					return fmt.Errorf("the term %q of %q is invalid: %s", term, domain, err.Error())
+				}
+
+				ips, err := e.lookupIP(ctx, target, ones4, ones6)
+				if err != nil {
+					return err
+				}
+
+				lines = append(lines, ips...)
+			}
+		}
+	}
+
+	e.documents = append(e.documents, sourceDocument{origin: domain, content: []byte(strings.Join(lines, "\n"))})
+
+	for _, include := range includes {
+		if err := e.expand(ctx, include, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lookupIP resolves the A and AAAA records of the domain into the subnets of the given prefix lengths.
+func (e *dnsExpander) lookupIP(ctx context.Context, domain string, ones4, ones6 int) ([]string, error) {
+	addrs, err := e.resolver.LookupIPAddr(ctx, strings.TrimSuffix(domain, ".")+".")
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve the addresses of %q: %s", domain, err.Error())
+	}
+
+	lines := make([]string, 0, len(addrs))
+	for _, v := range addrs {
+		ip, ones, bits := v.IP.To4(), ones4, 8*net.IPv4len
+		if ip == nil {
+			ip, ones, bits = v.IP.To16(), ones6, 8*net.IPv6len
+		}
+
+		mask := net.CIDRMask(ones, bits)
+		lines = append(lines, (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String())
+	}
+
+	return lines, nil
+}
+
+// parseDualCIDR parses the optional prefix lengths of the a term: /<ipv4 length>, //<ipv6 length> or both
+// of them, e.g. /24//64 (RFC 7208, section 5.6). The missing lengths are of the single addresses.
+func parseDualCIDR(lengths string) (int, int, error) {
+	ones4, ones6 := 8*net.IPv4len, 8*net.IPv6len
+
+	if lengths == "" {
+		return ones4, ones6, nil
+	}
+
+	v4, v6, hasV6 := strings.Cut(lengths, "//")
+
+	if v4 != "" {
+		ones, err := strconv.Atoi(strings.TrimPrefix(v4, "/"))
+		if err != nil || !strings.HasPrefix(v4, "/") || ones < 0 || ones > ones4 {
+			return 0, 0, fmt.Errorf("invalid IPv4 prefix length %q", v4)
+		}
+
+		ones4 = ones
+	}
+
+	if hasV6 {
+		ones, err := strconv.Atoi(v6)
+		if err != nil || ones < 0 || ones > ones6 {
+			return 0, 0, fmt.Errorf("invalid IPv6 prefix length %q", v6)
+		}
+
+		ones6 = ones
+	}
+
+	return ones4, ones6, nil
+}
@@ -0,0 +1,275 @@
+package reverseguard
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+)
+
+// dnsServer is a local stand-in DNS server answering the A, AAAA and TXT queries over UDP from the zone.
+// The unknown names get NXDOMAIN.
+type dnsServer struct {
+	conn net.PacketConn
+	mu   sync.Mutex
+	zone map[string][]string // "<name>/<type>" to the values
+}
+
+func newDNSServer(t testing.TB) *dnsServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoErrorf(t, err, "The DNS server should listen.")
+
+	server := &dnsServer{conn: conn, zone: make(map[string][]string)}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go server.serve()
+
+	return server
+}
+
+func (s *dnsServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *dnsServer) set(name string, recordType uint16, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.zone[dnsZoneKey(strings.ToLower(name), recordType)] = values
+}
+
+func dnsZoneKey(name string, recordType uint16) string {
+	return fmt.Sprintf("%s/%d", name, recordType)
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 1500)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if resp := s.answer(buf[:n]); resp != nil {
+			_, _ = s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnsServer) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// the question: the labels of the name, the type and the class
+	var labels []string
+
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		size := int(query[i])
+		if i+1+size > len(query) {
+			return nil
+		}
+
+		labels = append(labels, string(query[i+1:i+1+size]))
+		i += 1 + size
+	}
+
+	if i+5 > len(query) {
+		return nil
+	}
+
+	question := query[12 : i+5]
+	recordType := binary.BigEndian.Uint16(query[i+1 : i+3])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	s.mu.Lock()
+	values := s.zone[dnsZoneKey(name, recordType)]
+	known := false
+	for _, v := range []uint16{dnsTypeA, dnsTypeAAAA, dnsTypeTXT} {
+		if _, ok := s.zone[dnsZoneKey(name, v)]; ok {
+			known = true
+		}
+	}
+	s.mu.Unlock()
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	resp[2] = 0x80 | query[2]&0x01 // QR and RD
+	resp[3] = 0x80                 // RA
+	if !known {
+		resp[3] |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(values)))
+	resp = append(resp, question...)
+
+	for _, v := range values {
+		var rdata []byte
+
+		switch recordType {
+		case dnsTypeA:
+			rdata = net.ParseIP(v).To4()
+		case dnsTypeAAAA:
+			rdata = net.ParseIP(v).To16()
+		case dnsTypeTXT:
+			for len(v) > 255 {
+				rdata = append(append(rdata, 255), v[:255]...)
+				v = v[255:]
+			}
+			rdata = append(append(rdata, byte(len(v))), v...)
+		}
+
+		resp = append(resp, 0xc0, 12) // the pointer to the name of the question
+		resp = binary.BigEndian.AppendUint16(resp, recordType)
+		resp = binary.BigEndian.AppendUint16(resp, 1) // IN
+		resp = binary.BigEndian.AppendUint32(resp, 60)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+
+	return resp
+}
+
+func TestDNSSources(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	server := newDNSServer(t)
+	server.set("egress.partner.example", dnsTypeA, "192.0.2.10", "192.0.2.11")
+	server.set("egress.partner.example", dnsTypeAAAA, "2001:db8::10")
+	server.set("partner.example", dnsTypeTXT, "v=spf1 ip4:198.51.100.0/24 include:_spf.partner.example -ip4:203.0.113.66 ~all")
+	server.set("_spf.partner.example", dnsTypeTXT, "v=spf1 ip6:2001:db8:1::/48 a:egress.partner.example redirect=_spf2.partner.example")
+	server.set("_spf2.partner.example", dnsTypeTXT, "v=spf1 +ip4:203.0.113.0/28 mx ?all")
+	server.set("loop.example", dnsTypeTXT, "v=spf1 include:loop2.example")
+	server.set("loop2.example", dnsTypeTXT, "v=spf1 include:LOOP.example.")
+	server.set("deep.example", dnsTypeTXT, "v=spf1 include:deep1.example")
+	server.set("deep1.example", dnsTypeTXT, "v=spf1 include:deep2.example")
+	server.set("deep2.example", dnsTypeTXT, "v=spf1 ip4:192.0.2.0/24")
+	server.set("broken.example", dnsTypeTXT, "v=spf1 include:missing.example")
+	server.set("cidr.example", dnsTypeTXT, "v=spf1 a/24 a//120 a:egress.partner.example/30//64 -all")
+	server.set("cidr.example", dnsTypeA, "198.51.100.77")
+	server.set("cidr.example", dnsTypeAAAA, "2001:db8:2::77")
+	server.set("badcidr.example", dnsTypeTXT, "v=spf1 a/33")
+
+	t.Log("Given the need to check probably errors in the options of dns sources.")
+	{
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: "dns://partner.example?type=mx"}, "the dns record type \"mx\" is not supported"},
+			{&DynamicCIDR{Url: "dns://partner.example", DNSResolver: "127.0.0.1"}, "must be an address with a port"},
+			{&DynamicCIDR{Url: "dns://partner.example", DNSMaxDepth: -1}, "\"dns_max_depth\" option must not be negative"},
+			{&DynamicCIDR{Url: "dns://partner.example", Format: FormatJSON, JSONPaths: []string{"[]"}}, "not supported by dns sources"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the resolution of dns sources.")
+	{
+		tests := []struct {
+			url      string
+			maxDepth int
+			expected map[string]string
+		}{
+			{
+				"dns://egress.partner.example",
+				0,
+				map[string]string{"192.0.2.10/32": "egress.partner.example", "192.0.2.11/32": "egress.partner.example", "2001:db8::10/128": "egress.partner.example"},
+			},
+			{
+				"dns://partner.example?type=txt",
+				0,
+				map[string]string{
+					"198.51.100.0/24":  "partner.example",
+					"2001:db8:1::/48":  "_spf.partner.example",
+					"192.0.2.10/32":    "_spf.partner.example",
+					"192.0.2.11/32":    "_spf.partner.example",
+					"2001:db8::10/128": "_spf.partner.example",
+					"203.0.113.0/28":   "_spf2.partner.example",
+				},
+			},
+			{
+				"dns://deep.example?type=txt",
+				2,
+				map[string]string{"192.0.2.0/24": "deep2.example"},
+			},
+			{
+				"dns://cidr.example?type=txt",
+				0,
+				map[string]string{
+					"198.51.100.0/24":    "cidr.example",
+					"2001:db8:2::77/128": "cidr.example",
+					"198.51.100.77/32":   "cidr.example",
+					"2001:db8:2::/120":   "cidr.example",
+					"192.0.2.8/30":       "cidr.example",
+					"2001:db8::/64":      "cidr.example",
+				},
+			},
+		}
+
+		for testId, test := range tests {
+			dyn := &DynamicCIDR{Url: test.url, DNSResolver: server.addr(), DNSMaxDepth: test.maxDepth}
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			origins := make(map[string]string)
+			for _, v := range dyn.cidrs() {
+				origins[v.cidr.String()] = v.origin
+			}
+
+			t.Logf("\tTest %d: Whether the source %q is resolved with the domain of every subnet.", testId, test.url)
+			require.NoErrorf(t, err, "An error should not occur if the records are valid.")
+			require.Equalf(t, test.expected, origins, "The subnets should be tagged with the domains they come from.")
+		}
+	}
+
+	t.Log("Given the need to check the errors of the include expansion.")
+	{
+		tests := []struct {
+			url      string
+			maxDepth int
+			expected string
+		}{
+			{"dns://loop.example?type=txt", 0, "the include loop is detected at \"loop.example\""},
+			{"dns://deep.example?type=txt", 1, "the include depth limit of 1 is exceeded at \"deep2.example\""},
+			{"dns://broken.example?type=txt", 0, "unable to resolve the TXT records of \"missing.example\""},
+			{"dns://missing.example", 0, "unable to resolve the addresses of \"missing.example\""},
+			{"dns://badcidr.example?type=txt", 0, "the term \"a/33\" of \"badcidr.example\" is invalid: invalid IPv4 prefix length \"/33\""},
+		}
+
+		for testId, test := range tests {
+			dyn := &DynamicCIDR{Url: test.url, DNSResolver: server.addr(), DNSMaxDepth: test.maxDepth, timeout: defaultTimeout}
+			if dyn.DNSMaxDepth == 0 {
+				dyn.DNSMaxDepth = defaultDNSMaxDepth
+			}
+
+			_, err := dyn.update()
+
+			t.Logf("\tTest %d: Whether the source %q fails with the error %q.", testId, test.url, test.expected)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+}
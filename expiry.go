@@ -0,0 +1,143 @@
+package reverseguard
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// expireEntries applies the expiry to the subnet list: the entries expired by now, or all the entries
+// of a stale source, are dropped or marked as denied. The entries denied before are kept as is.
+// It returns the resulting list and the entries which have just expired.
+func expireEntries(list []cidrEntry, now time.Time, onExpiry string, stale bool) ([]cidrEntry, []cidrEntry) {
+	var result, expired []cidrEntry
+
+	for _, entry := range list {
+		if entry.denied || !stale && (entry.expires.IsZero() || now.Before(entry.expires)) {
+			result = append(result, entry)
+			continue
+		}
+
+		expired = append(expired, entry)
+
+		if onExpiry == ExpiryDeny {
+			entry.denied = true
+			result = append(result, entry)
+		}
+	}
+
+	return result, expired
+}
+
+// expiryVerb describes what happens to the expired entries of the source, for the logs.
+func (d *DynamicCIDR) expiryVerb() string {
+	if d.OnExpiry == ExpiryDeny {
+		return "denied"
+	}
+
+	return "dropped"
+}
+
+// reportExpired logs the expired entries, the first ones of them at most.
+func (d *DynamicCIDR) reportExpired(expired []cidrEntry) {
+	const maxReported = 10
+
+	var entries []string
+
+	for i, entry := range expired {
+		if i == maxReported {
+			entries = append(entries, fmt.Sprintf("and %d more", len(expired)-maxReported))
+			break
+		}
+
+		entries = append(entries, fmt.Sprintf("%s (expired at %s)", entry.cidr, entry.expires.Format(time.RFC3339)))
+	}
+
+	writeErr(fmt.Sprintf("Endpoint %q, %d subnets have expired and are %s: %s", d.Url, len(expired), d.expiryVerb(), strings.Join(entries, ", ")))
+}
+
+// stale reports whether the last successful refresh of the source, or the last change of its files,
+// is older than its max_staleness.
+func (d *DynamicCIDR) stale(now time.Time) bool {
+	return d.maxStaleness > 0 && !d.refreshedAt.IsZero() && now.Sub(d.refreshedAt) >= d.maxStaleness
+}
+
+// applyExpiry drops or denies the expired entries of the list, or all of them if the source is stale, and logs them.
+// It returns the resulting list and the number of the entries which have just expired.
+func (d *DynamicCIDR) applyExpiry(list []cidrEntry, now time.Time) ([]cidrEntry, int) {
+	stale := d.stale(now)
+
+	list, expired := expireEntries(list, now, d.OnExpiry, stale)
+	if len(expired) == 0 {
+		return list, 0
+	}
+
+	if !stale {
+		d.reportExpired(expired)
+
+		return list, len(expired)
+	}
+
+	writeErr(fmt.Sprintf(
+		"Endpoint %q, the list dates from %s, which exceeds the max_staleness of %s. All of its %d subnets are %s",
+		d.Url,
+		d.refreshedAt.Format(time.RFC822),
+		d.maxStaleness,
+		len(expired),
+		d.expiryVerb(),
+	))
+
+	// the next refresh must fetch the whole list anew rather than confirm the expired one.
+	// The files are re-read once they change anyway.
+	d.etag = ""
+	d.lastModified = ""
+
+	return list, len(expired)
+}
+
+// expire drops or denies the expired entries of the source, or all of them if the source is stale.
+// It reports whether the list has changed.
+func (d *DynamicCIDR) expire() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list, expired := d.applyExpiry(d.cidrs(), time.Now())
+	if expired == 0 {
+		return false
+	}
+
+	d.setCIDRs(list)
+
+	return true
+}
+
+// nextExpiry returns the time the next entry of the source expires at, or the source becomes stale.
+// It is zero if nothing expires.
+func (d *DynamicCIDR) nextExpiry() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var next time.Time
+	var live bool
+
+	for _, entry := range d.cidrs() {
+		if entry.denied {
+			continue
+		}
+
+		live = true
+
+		if !entry.expires.IsZero() && (next.IsZero() || entry.expires.Before(next)) {
+			next = entry.expires
+		}
+	}
+
+	// the source without entries left to expire does not become stale
+	if live && d.maxStaleness > 0 && !d.refreshedAt.IsZero() {
+		if staleAt := d.refreshedAt.Add(d.maxStaleness); next.IsZero() || staleAt.Before(next) {
+			next = staleAt
+		}
+	}
+
+	return next
+}
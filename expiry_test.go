@@ -0,0 +1,153 @@
+package reverseguard
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the expiry options of dynamic_cidrs sections.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: server.URL, OnExpiry: "forget"}, "the on_expiry action \"forget\" is not valid"},
+			{&DynamicCIDR{Url: server.URL, RawMaxStaleness: "1d"}, "invalid max_staleness \"1d\""},
+			{&DynamicCIDR{Url: server.URL, RawMaxStaleness: "-1h"}, "invalid max_staleness \"-1h\""},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "partner", "An error message should contain a name of configuration in which an error occurred.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+
+		testId := len(tests)
+
+		items := map[string]*ReverseProxy{"partner": {
+			RawStaticCIDRs:   []string{"0.0.0.0/0"},
+			DenyDynamicCIDRs: []*DynamicCIDR{{Url: server.URL, OnExpiry: ExpiryDrop}},
+		}}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		t.Logf("\tTest %d: Whether the expired entries of a deny list may not be dropped.", testId)
+		require.ErrorContainsf(t, err, "the on_expiry action \"drop\" is not allowed in deny_dynamic_cidrs", "An error should occur if a deny list drops the expired entries.")
+
+		testId++
+
+		_, _, invalid := parseTextList([]byte("192.0.2.0/24 expires=tomorrow\n"))
+
+		t.Logf("\tTest %d: Whether an invalid expiry time makes the entry invalid.", testId)
+		require.Lenf(t, invalid, 1, "The entry should be invalid.")
+		require.EqualErrorf(t, invalid[0], "invalid expiry time \"tomorrow\", RFC 3339 expected at line 1", "The error should point to the line.")
+	}
+
+	t.Log("Given the need to check the expiry of the annotated entries.")
+	{
+		expires := time.Now().Add(500 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+		expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+		path := filepath.Join(t.TempDir(), "grants.txt")
+		content := fmt.Sprintf("192.0.2.0/24 expires=%s\n198.51.100.0/24 expires=%s\n203.0.113.0/24\n", expires, expired)
+		require.NoErrorf(t, os.WriteFile(path, []byte(content), 0o600), "The file should be writable.")
+
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: "file://" + path}}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an entry which has already expired is not loaded.", testId)
+		require.Nilf(t, plugin.lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP of the expired entry should not be trusted.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")), "The IP of the entry which has not expired yet should be trusted.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether an entry is dropped once it expires.", testId)
+		require.Eventuallyf(t, func() bool {
+			return plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")) == nil
+		}, 2*time.Second, 10*time.Millisecond, "The IP of the expired entry should not be trusted.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("203.0.113.1")), "The IP of the entry without an expiry should be trusted.")
+	}
+
+	t.Log("Given the need to check the expiry of a deny list.")
+	{
+		expires := time.Now().Add(300 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+
+		path := filepath.Join(t.TempDir(), "blocked.txt")
+		require.NoErrorf(t, os.WriteFile(path, []byte(fmt.Sprintf("192.0.2.0/24 expires=%s\n", expires)), 0o600), "The file should be writable.")
+
+		dyn := &DynamicCIDR{Url: "file://" + path}
+		items := map[string]*ReverseProxy{"partner": {RawStaticCIDRs: []string{"0.0.0.0/0"}, DenyDynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the expired entries of a deny list keep being denied.", testId)
+		require.Equalf(t, ExpiryDeny, dyn.OnExpiry, "The expired entries of a deny list should be denied by default.")
+		require.Eventuallyf(t, func() bool {
+			list := dyn.cidrs()
+			return len(list) == 1 && list[0].denied
+		}, 2*time.Second, 10*time.Millisecond, "The entry should expire.")
+		require.Nilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")), "The IP of the expired entry should stay denied.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP of the other subnets should be trusted.")
+	}
+
+	t.Log("Given the need to check the expiry of a stale source.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		dyn := &DynamicCIDR{Url: server.URL, RawMaxStaleness: "300ms", OnExpiry: ExpiryDeny}
+		items := map[string]*ReverseProxy{"partner": {RawStaticCIDRs: []string{"0.0.0.0/0"}, DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the entries of a stale source are denied.", testId)
+		require.Eventuallyf(t, func() bool {
+			return plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")) == nil
+		}, 2*time.Second, 10*time.Millisecond, "The IP of the stale source should be denied.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP of the other subnets should be trusted.")
+
+		testId++
+
+		result, err := dyn.update()
+
+		t.Logf("\tTest %d: Whether a successful refresh restores the list.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the source is available.")
+		require.Falsef(t, result.unchanged, "The expired list should be fetched anew.")
+		require.Lenf(t, dyn.cidrs(), 1, "The list should be restored.")
+		require.Falsef(t, dyn.cidrs()[0].denied, "The restored entries should not be denied.")
+	}
+}
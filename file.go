@@ -0,0 +1,149 @@
+package reverseguard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// filePaths returns the files of the file source in lexical order. The url may point to a single file,
+// to a directory or to a glob pattern (e.g. file:///etc/reverseguard/partners.d/*.txt). The hidden files
+// of directories and patterns are skipped, so are the subdirectories.
+func (d *DynamicCIDR) filePaths() ([]string, error) {
+	pattern := d.Url[7:len(d.Url)]
+
+	if strings.ContainsAny(pattern, "*?[") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("the glob pattern %q is invalid", pattern)
+		}
+
+		return regularFiles(matches), nil
+	}
+
+	info, err := statFile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{pattern}, nil
+	}
+
+	entries, err := os.ReadDir(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the directory %q: %s", pattern, err.Error())
+	}
+
+	paths := make([]string, 0, len(entries))
+	for _, v := range entries {
+		paths = append(paths, filepath.Join(pattern, v.Name()))
+	}
+
+	return regularFiles(paths), nil
+}
+
+// regularFiles filters out the hidden files (e.g. the swap files of editors), the detached signatures
+// and everything but the regular files. The symbolic links are followed.
+func regularFiles(paths []string) []string {
+	var files []string
+
+	for _, path := range paths {
+		if strings.HasPrefix(filepath.Base(path), ".") || strings.HasSuffix(path, signatureSuffix) {
+			continue
+		}
+
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+
+	return files
+}
+
+func statFile(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("the file %q does not exist", path)
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("no permissions to read the file %q", path)
+		}
+
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// readFiles reads the files of the file source. If neither the set of the files nor any of them has changed
+// since the last accepted read, the content is not read at all.
+func (d *DynamicCIDR) readFiles() (*readResult, error) {
+	paths, err := d.filePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]os.FileInfo, len(paths))
+
+	for _, path := range paths {
+		info, err := statFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		infos[path] = info
+	}
+
+	if !d.filesChanged(infos) {
+		return &readResult{notModified: true}, nil
+	}
+
+	result := &readResult{fileInfos: infos}
+
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		result.documents = append(result.documents, sourceDocument{origin: path, content: content})
+	}
+
+	return result, nil
+}
+
+// filesChanged reports whether a file has appeared or disappeared since the last accepted read, or whether a file
+// differs by the inode, the size or the modification time. inotify is not available in the plugin,
+// so the changes are detected by polling.
+func (d *DynamicCIDR) filesChanged(infos map[string]os.FileInfo) bool {
+	if d.fileInfos == nil || len(d.fileInfos) != len(infos) {
+		return true
+	}
+
+	for path, info := range infos {
+		last, ok := d.fileInfos[path]
+		if !ok || !os.SameFile(last, info) || last.Size() != info.Size() || !last.ModTime().Equal(info.ModTime()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newestModTime returns the modification time of the most recently changed file.
+func newestModTime(infos map[string]os.FileInfo) time.Time {
+	var newest time.Time
+
+	for _, info := range infos {
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return newest
+}
@@ -0,0 +1,124 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		require.NoErrorf(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600), "The file %q should be writable.", name)
+	}
+
+	write("a.txt", "# partner A\r\n192.0.2.0/24\r\n\r\n198.51.100.0/24 # office\r\n")
+	write("b.txt", "198.51.100.0/24\n203.0.113.0/24\n")
+	write("c.conf", "100.64.0.0/10\n")
+	write(".b.txt.swp", "garbage\n")
+	require.NoErrorf(t, os.Mkdir(filepath.Join(dir, "archive"), 0o700), "The subdirectory should be created.")
+
+	origins := func(dyn *DynamicCIDR) map[string]string {
+		result := make(map[string]string)
+		for _, v := range dyn.cidrs() {
+			result[v.cidr.String()] = filepath.Base(v.origin)
+		}
+
+		return result
+	}
+
+	t.Log("Given the need to check the directory and glob sources.")
+	{
+		tests := []struct {
+			url      string
+			expected map[string]string
+		}{
+			{
+				"file://" + dir,
+				map[string]string{"192.0.2.0/24": "a.txt", "198.51.100.0/24": "a.txt", "203.0.113.0/24": "b.txt", "100.64.0.0/10": "c.conf"},
+			},
+			{
+				"file://" + filepath.Join(dir, "*.txt"),
+				map[string]string{"192.0.2.0/24": "a.txt", "198.51.100.0/24": "a.txt", "203.0.113.0/24": "b.txt"},
+			},
+			{
+				"file://" + filepath.Join(dir, "b.txt"),
+				map[string]string{"198.51.100.0/24": "b.txt", "203.0.113.0/24": "b.txt"},
+			},
+		}
+
+		for testId, test := range tests {
+			dyn := &DynamicCIDR{Url: test.url}
+
+			result, err := dyn.update()
+
+			t.Logf("\tTest %d: Whether the source %q is loaded with the origin of every subnet.", testId, test.url)
+			require.NoErrorf(t, err, "An error should not occur if the source is valid.")
+			require.Equalf(t, test.expected, origins(dyn), "The subnets should be tagged with the files they come from.")
+			require.Equalf(t, len(test.expected), result.total, "The duplicates should not be counted.")
+		}
+	}
+
+	t.Log("Given the need to check the errors of the directory and glob sources.")
+	{
+		write("broken.list", "192.0.2.0/24\ngarbage\n")
+
+		tests := []struct {
+			url      string
+			expected string
+		}{
+			{"file://" + filepath.Join(dir, "[.txt"), "is invalid"},
+			{"file://" + filepath.Join(dir, "missing"), "does not exist"},
+			{"file://" + filepath.Join(dir, "*.list"), "broken.list"},
+		}
+
+		for testId, test := range tests {
+			_, err := (&DynamicCIDR{Url: test.url}).update()
+
+			t.Logf("\tTest %d: Whether the source %q fails with the error %q.", testId, test.url, test.expected)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+
+		require.NoErrorf(t, os.Remove(filepath.Join(dir, "broken.list")), "The file should be removable.")
+	}
+
+	t.Log("Given the need to check that the files appearing and disappearing are picked up.")
+	{
+		dyn := &DynamicCIDR{Url: "file://" + filepath.Join(dir, "*.txt"), RawWatchInterval: "20ms"}
+		items := map[string]*ReverseProxy{"partners": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		write("d.txt", "100.64.0.0/10\n")
+
+		t.Logf("\tTest %d: Whether the subnets of a new file are trusted.", testId)
+		require.Eventuallyf(t, func() bool {
+			return plugin.lookupTrustedSet(net.ParseIP("100.64.0.1")) != nil
+		}, 2*time.Second, 10*time.Millisecond, "The IP of the new file should be trusted.")
+
+		testId++
+
+		require.NoErrorf(t, os.Remove(filepath.Join(dir, "b.txt")), "The file should be removable.")
+
+		t.Logf("\tTest %d: Whether the subnets of a removed file are not trusted anymore.", testId)
+		require.Eventuallyf(t, func() bool {
+			return plugin.lookupTrustedSet(net.ParseIP("203.0.113.1")) == nil
+		}, 2*time.Second, 10*time.Millisecond, "The IP of the removed file should not be trusted.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP shared with the remaining file should be trusted.")
+	}
+}
@@ -0,0 +1,317 @@
+package reverseguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultMinValidRatio is the fraction of the entries which must be valid for a source with invalid entries skipped.
+const defaultMinValidRatio = 0.9
+
+// listEntry is a subnet of a text list along with its position and annotations.
+type listEntry struct {
+	cidr        *net.IPNet
+	line        int
+	annotations map[string]string
+	expires     time.Time // the "expires" annotation, zero if the entry never expires
+}
+
+// listError is an invalid entry of a subnet list. The line is zero for the entries of JSON documents.
+type listError struct {
+	line    int
+	message string
+}
+
+func (e *listError) Error() string {
+	if e.line == 0 {
+		return e.message
+	}
+
+	return fmt.Sprintf("%s at line %d", e.message, e.line)
+}
+
+// parseTextList parses the text subnet list. Every line holds a subnet, a single IP or an IP range
+// (e.g. 192.0.2.10-192.0.2.20), which is converted to the minimal set of subnets. The entry may be followed
+// by the "key=value" annotations separated by whitespace and by a "# comment". The "expires" annotation holds
+// the RFC 3339 time the entry expires at. The blank lines and the comment lines are skipped. Any line endings are accepted, as well as the UTF-8 byte order mark.
+// The invalid lines are returned separately along with the number of the valid ones.
+func parseTextList(content []byte) ([]listEntry, int, []*listError) {
+	text := strings.TrimPrefix(string(content), "\uFEFF")
+	text = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\v", "\n", "\f", "\n").Replace(text)
+
+	var entries []listEntry
+	var invalid []*listError
+	var valid int
+
+lines:
+	for i, line := range strings.Split(text, "\n") {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		cidrs, err := parseListValue(fields[0])
+		if err != nil {
+			invalid = append(invalid, &listError{line: i + 1, message: fmt.Sprintf("invalid entry %q", fields[0])})
+			continue
+		}
+
+		var annotations map[string]string
+
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok || key == "" {
+				invalid = append(invalid, &listError{line: i + 1, message: fmt.Sprintf("invalid annotation %q", field)})
+				continue lines
+			}
+
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+
+			annotations[key] = value
+		}
+
+		var expires time.Time
+
+		if value, ok := annotations["expires"]; ok {
+			expires, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				invalid = append(invalid, &listError{line: i + 1, message: fmt.Sprintf("invalid expiry time %q, RFC 3339 expected", value)})
+				continue
+			}
+		}
+
+		valid++
+
+		for _, cidr := range cidrs {
+			entries = append(entries, listEntry{cidr: cidr, line: i + 1, annotations: annotations, expires: expires})
+		}
+	}
+
+	return entries, valid, invalid
+}
+
+// parseListValue parses a subnet, a single IP or an IP range.
+func parseListValue(value string) ([]*net.IPNet, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	if !isRange {
+		cidr, err := parseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*net.IPNet{cidr}, nil
+	}
+
+	start, err := parseIP(first)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := parseIP(last)
+	if err != nil {
+		return nil, err
+	}
+
+	return rangeToCIDRs(start, end)
+}
+
+// rangeToCIDRs converts the inclusive IP range to the minimal set of subnets covering it exactly.
+func rangeToCIDRs(start, end net.IP) ([]*net.IPNet, error) {
+	if len(start) != len(end) {
+		return nil, fmt.Errorf("the range %s-%s mixes IPv4 and IPv6", start, end)
+	}
+
+	bits := len(start) * 8
+	from := new(big.Int).SetBytes(start)
+	to := new(big.Int).SetBytes(end)
+
+	if from.Cmp(to) > 0 {
+		return nil, fmt.Errorf("the range %s-%s is reversed", start, end)
+	}
+
+	var cidrs []*net.IPNet
+
+	one := big.NewInt(1)
+
+	for from.Cmp(to) <= 0 {
+		// the largest block aligned at the start which doesn't overrun the end
+		size := int(from.TrailingZeroBits())
+		if from.Sign() == 0 || size > bits {
+			size = bits
+		}
+
+		for size > 0 {
+			last := new(big.Int).Lsh(one, uint(size))
+			last.Add(last, from).Sub(last, one)
+
+			if last.Cmp(to) <= 0 {
+				break
+			}
+
+			size--
+		}
+
+		cidrs = append(cidrs, &net.IPNet{
+			IP:   net.IP(from.FillBytes(make([]byte, len(start)))),
+			Mask: net.CIDRMask(bits-size, bits),
+		})
+
+		from.Add(from, new(big.Int).Lsh(one, uint(size)))
+	}
+
+	return cidrs, nil
+}
+
+// extractJSON extracts the subnets from the JSON document by the path expressions.
+//
+// A path is a dot-separated list of object keys. A key followed by "[]" iterates over the array stored by this key,
+// and a bare "[]" iterates over the current array (e.g. the top-level one). A path may end with a string or with
+// an array of strings. For example:
+//
+//	prefixes[].ip_prefix       AWS ip-ranges.json
+//	prefixes[].ipv4Prefix      GCP cloud.json
+//	addresses[]                Fastly public-ip-list
+//	result.ipv4_cidrs[]        Cloudflare /client/v4/ips
+//
+// The filter is applied to the object holding the final value: its fields must be equal to the filter values.
+// The objects which lack the final key are skipped.
+func extractJSON(content []byte, paths []string, filter map[string]string) ([]string, error) {
+	var document interface{}
+
+	if err := json.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("invalid JSON document: %s", err.Error())
+	}
+
+	var entries []string
+
+	for _, path := range paths {
+		segments, err := splitJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var found bool
+
+		if err := walkJSON(document, segments, nil, filter, path, &entries, &found); err != nil {
+			return nil, err
+		}
+
+		// an error body or a renamed key must not be taken for an empty list
+		if !found {
+			return nil, fmt.Errorf("the JSON path %q is not found in the document", path)
+		}
+	}
+
+	return entries, nil
+}
+
+// splitJSONPath splits the path expression into segments and validates them.
+func splitJSONPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("the JSON path is empty")
+	}
+
+	segments := strings.Split(path, ".")
+
+	for _, segment := range segments {
+		name := strings.TrimSuffix(segment, "[]")
+
+		if segment == "" || strings.ContainsAny(name, "[]") {
+			return nil, fmt.Errorf("the JSON path %q is invalid", path)
+		}
+	}
+
+	return segments, nil
+}
+
+// walkJSON collects the values of the path. The found flag is set once the path leads to a value,
+// or to an empty array, which is a genuinely empty list.
+func walkJSON(node interface{}, segments []string, parent map[string]interface{}, filter map[string]string, path string, entries *[]string, found *bool) error {
+	if len(segments) == 0 {
+		*found = true
+
+		if !matchJSONFilter(parent, filter) {
+			return nil
+		}
+
+		switch v := node.(type) {
+		case string:
+			*entries = append(*entries, v)
+		case []interface{}:
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("the JSON path %q leads to an array of non-string values", path)
+				}
+
+				*entries = append(*entries, s)
+			}
+		default:
+			return fmt.Errorf("the JSON path %q leads to a non-string value", path)
+		}
+
+		return nil
+	}
+
+	segment := segments[0]
+	name := strings.TrimSuffix(segment, "[]")
+
+	if name != "" {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("the JSON path %q expects an object at %q", path, segment)
+		}
+
+		parent = object
+
+		if node, ok = object[name]; !ok {
+			return nil
+		}
+	}
+
+	if !strings.HasSuffix(segment, "[]") {
+		return walkJSON(node, segments[1:], parent, filter, path, entries, found)
+	}
+
+	items, ok := node.([]interface{})
+	if !ok {
+		return fmt.Errorf("the JSON path %q expects an array at %q", path, segment)
+	}
+
+	if len(items) == 0 {
+		*found = true
+	}
+
+	for _, item := range items {
+		if err := walkJSON(item, segments[1:], parent, filter, path, entries, found); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func matchJSONFilter(object map[string]interface{}, filter map[string]string) bool {
+	for key, expected := range filter {
+		if object == nil {
+			return false
+		}
+
+		value, ok := object[key]
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+
+	return true
+}
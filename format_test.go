@@ -0,0 +1,303 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"testing"
+)
+
+const (
+	awsIPRanges = `{
+  "syncToken": "1697000000",
+  "createDate": "2023-10-11-00-00-00",
+  "prefixes": [
+    {"ip_prefix": "3.2.34.0/26", "region": "af-south-1", "service": "AMAZON", "network_border_group": "af-south-1"},
+    {"ip_prefix": "13.32.0.0/15", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"},
+    {"ip_prefix": "52.46.0.0/18", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"}
+  ],
+  "ipv6_prefixes": [
+    {"ipv6_prefix": "2600:9000::/28", "region": "GLOBAL", "service": "CLOUDFRONT", "network_border_group": "GLOBAL"}
+  ]
+}`
+	gcpCloud = `{
+  "syncToken": "1697000000",
+  "prefixes": [
+    {"ipv4Prefix": "34.80.0.0/15", "service": "Google Cloud", "scope": "asia-east1"},
+    {"ipv6Prefix": "2600:1900:4030::/44", "service": "Google Cloud", "scope": "asia-east1"}
+  ]
+}`
+	fastlyPublicIPList = `{"addresses": ["23.235.32.0/20", "43.249.72.0/22"], "ipv6_addresses": ["2a04:4e40::/32"]}`
+	cloudflareAPI      = `{"result": {"ipv4_cidrs": ["173.245.48.0/20"], "ipv6_cidrs": ["2400:cb00::/32"], "etag": "38f79d050aa027e3be3865e495dcc9bc"}, "success": true, "errors": [], "messages": []}`
+)
+
+func TestExtractJSON(t *testing.T) {
+	t.Log("Given the need to check the extraction of the subnets from the JSON documents of the providers.")
+	{
+		tests := []struct {
+			name     string
+			document string
+			paths    []string
+			filter   map[string]string
+			expected []string
+		}{
+			{"AWS", awsIPRanges, []string{"prefixes[].ip_prefix", "ipv6_prefixes[].ipv6_prefix"}, nil, []string{"3.2.34.0/26", "13.32.0.0/15", "52.46.0.0/18", "2600:9000::/28"}},
+			{"AWS CloudFront", awsIPRanges, []string{"prefixes[].ip_prefix"}, map[string]string{"service": "CLOUDFRONT", "region": "GLOBAL"}, []string{"13.32.0.0/15", "52.46.0.0/18"}},
+			{"GCP", gcpCloud, []string{"prefixes[].ipv4Prefix", "prefixes[].ipv6Prefix"}, nil, []string{"34.80.0.0/15", "2600:1900:4030::/44"}},
+			{"Fastly", fastlyPublicIPList, []string{"addresses[]", "ipv6_addresses"}, nil, []string{"23.235.32.0/20", "43.249.72.0/22", "2a04:4e40::/32"}},
+			{"Cloudflare API", cloudflareAPI, []string{"result.ipv4_cidrs[]", "result.ipv6_cidrs[]"}, nil, []string{"173.245.48.0/20", "2400:cb00::/32"}},
+			{"top-level array", `["192.0.2.1", "192.0.2.2"]`, []string{"[]"}, nil, []string{"192.0.2.1", "192.0.2.2"}},
+			{"empty list", `{"addresses": [], "ipv6_addresses": []}`, []string{"addresses[]", "ipv6_addresses[].cidr"}, nil, nil},
+		}
+
+		for testId, test := range tests {
+			entries, err := extractJSON([]byte(test.document), test.paths, test.filter)
+
+			t.Logf("\tTest %d: Whether the subnets are extracted from the %s document by the paths %q.", testId, test.name, test.paths)
+			require.NoErrorf(t, err, "An error should not occur while extracting the subnets.")
+			require.Equalf(t, test.expected, entries, "The subnets should be extracted from the %s document.", test.name)
+		}
+	}
+
+	t.Log("Given the need to check probably errors in the JSON documents and paths.")
+	{
+		tests := []struct {
+			document string
+			paths    []string
+			expected string
+		}{
+			{`{"prefixes": [`, []string{"prefixes[]"}, "invalid JSON document"},
+			{awsIPRanges, []string{""}, "the JSON path is empty"},
+			{awsIPRanges, []string{"prefixes..ip_prefix"}, "is invalid"},
+			{awsIPRanges, []string{"pre[fixes"}, "is invalid"},
+			{awsIPRanges, []string{"prefixes[]"}, "leads to a non-string value"},
+			{`{"list": [1, 2]}`, []string{"list"}, "array of non-string values"},
+			{awsIPRanges, []string{"syncToken[]"}, "expects an array"},
+			{awsIPRanges, []string{"syncToken.value"}, "expects an object"},
+			{`{"count": 1}`, []string{"count"}, "non-string value"},
+			{`{"message": "rate limited"}`, []string{"addresses[]"}, "the JSON path \"addresses[]\" is not found"},
+			{awsIPRanges, []string{"prefixes[].ip_prefix", "prefixes[].ipv4Prefix"}, "the JSON path \"prefixes[].ipv4Prefix\" is not found"},
+		}
+
+		for testId, test := range tests {
+			_, err := extractJSON([]byte(test.document), test.paths, nil)
+
+			t.Logf("\tTest %d: Whether the error %q occurs for the paths %q.", testId, test.expected, test.paths)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+}
+
+func TestJSONSources(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the format options of dynamic_cidrs sections.")
+	{
+		server := newListServer(t, awsIPRanges)
+
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: server.URL, Format: "xml"}, "the format \"xml\" is not valid"},
+			{&DynamicCIDR{Url: server.URL, Format: FormatJSON}, "\"json_paths\" option is required"},
+			{&DynamicCIDR{Url: server.URL, Format: FormatJSON, JSONPaths: []string{"a..b"}}, "the JSON path \"a..b\" is invalid"},
+			{&DynamicCIDR{Url: server.URL, Format: FormatJSON, JSONPaths: []string{"syncToken"}}, "invalid CIDR \"1697000000\""},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"aws": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "aws", "An error message should contain a name of configuration in which an error occurred.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check that the subnets from a JSON source are trusted.")
+	{
+		server := newListServer(t, awsIPRanges)
+		items := map[string]*ReverseProxy{
+			"cloudfront": {
+				DynamicCIDRs: []*DynamicCIDR{
+					{Url: server.URL, Format: FormatJSON, JSONPaths: []string{"prefixes[].ip_prefix"}, JSONFilter: map[string]string{"service": "CLOUDFRONT"}},
+				},
+			},
+		}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an IP from the filtered subnets is trusted.", testId)
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("13.32.0.1")), "The IP should be trusted.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether an IP from the filtered out subnets is not trusted.", testId)
+		require.Nilf(t, plugin.lookupTrustedSet(net.ParseIP("3.2.34.1")), "The IP should not be trusted.")
+	}
+}
+
+func TestParseTextList(t *testing.T) {
+	t.Log("Given the need to check the parsing of the text subnet lists.")
+	{
+		tests := []struct {
+			name     string
+			content  string
+			expected []string
+		}{
+			{"plain", "192.0.2.0/24\n198.51.100.1\n2001:db8::/32\n", []string{"192.0.2.0/24", "198.51.100.1/32", "2001:db8::/32"}},
+			{"comments", "# partners\n\n192.0.2.0/24 # office\n  # indented comment\n\t198.51.100.0/24\t\n", []string{"192.0.2.0/24", "198.51.100.0/24"}},
+			{"BOM and CRLF", "\uFEFF192.0.2.0/24\r\n198.51.100.0/24\r\n", []string{"192.0.2.0/24", "198.51.100.0/24"}},
+			{"mixed line endings", "192.0.2.0/24\r198.51.100.0/24\n203.0.113.0/24\r\n", []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"}},
+			{"no trailing newline", "192.0.2.0/24", []string{"192.0.2.0/24"}},
+			{"range", "192.0.2.10-192.0.2.20", []string{"192.0.2.10/31", "192.0.2.12/30", "192.0.2.16/30", "192.0.2.20/32"}},
+			{"aligned range", "192.0.2.0-192.0.2.255", []string{"192.0.2.0/24"}},
+			{"single IP range", "192.0.2.7-192.0.2.7", []string{"192.0.2.7/32"}},
+			{"full range", "0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+			{"IPv6 range", "2001:db8::-2001:db8::1:ffff", []string{"2001:db8::/111"}},
+			{"annotations", "192.0.2.0/24 owner=ops expires=2026-11-01T00:00:00Z # note", []string{"192.0.2.0/24"}},
+		}
+
+		for testId, test := range tests {
+			entries, _, invalid := parseTextList([]byte(test.content))
+
+			var cidrs []string
+			for _, v := range entries {
+				cidrs = append(cidrs, v.cidr.String())
+			}
+
+			t.Logf("\tTest %d: Whether the %s list is parsed.", testId, test.name)
+			require.Emptyf(t, invalid, "No entries of the %s list should be invalid.", test.name)
+			require.Equalf(t, test.expected, cidrs, "The subnets of the %s list should be parsed.", test.name)
+		}
+
+		entries, _, _ := parseTextList([]byte("# header\n\n192.0.2.0/24 owner=ops\n"))
+
+		testId := len(tests)
+
+		t.Logf("\tTest %d: Whether the line numbers and the annotations are kept.", testId)
+		require.Equalf(t, 3, entries[0].line, "The line number should be kept.")
+		require.Equalf(t, map[string]string{"owner": "ops"}, entries[0].annotations, "The annotations should be kept.")
+	}
+
+	t.Log("Given the need to check probably errors in the text subnet lists.")
+	{
+		tests := []struct {
+			content  string
+			expected string
+		}{
+			{"192.0.2.0/24\n\ngarbage\n", "invalid entry \"garbage\" at line 3"},
+			{"192.0.2.0/33", "invalid entry \"192.0.2.0/33\" at line 1"},
+			{"192.0.2.20-192.0.2.10", "invalid entry \"192.0.2.20-192.0.2.10\" at line 1"},
+			{"192.0.2.1-2001:db8::1", "invalid entry \"192.0.2.1-2001:db8::1\" at line 1"},
+			{"192.0.2.0/24 office", "invalid annotation \"office\" at line 1"},
+		}
+
+		for testId, test := range tests {
+			_, _, invalid := parseTextList([]byte(test.content))
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.Lenf(t, invalid, 1, "One entry should be invalid.")
+			require.ErrorContainsf(t, invalid[0], test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+}
+
+func TestInvalidEntryPolicy(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	ratio := func(v float64) *float64 {
+		return &v
+	}
+
+	t.Log("Given the need to check probably errors in the invalid entry options of dynamic_cidrs sections.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: server.URL, OnInvalidEntry: "ignore"}, "the on_invalid_entry policy \"ignore\" is not valid"},
+			{&DynamicCIDR{Url: server.URL, OnInvalidEntry: InvalidEntrySkip, MinValidRatio: ratio(1.5)}, "\"min_valid_ratio\" option must be between 0 and 1"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the policies for the invalid entries.")
+	{
+		list := "192.0.2.0/24\n198.51.100.0/24\n203.0.113.0/24\n100.64.0.0/10\nbroken\n"
+
+		tests := []struct {
+			name        string
+			content     string
+			dynamicCIDR *DynamicCIDR
+			total       int
+			expected    string
+		}{
+			{"fail", list, &DynamicCIDR{}, 0, "invalid entry \"broken\" at line 5"},
+			{"skip", list, &DynamicCIDR{OnInvalidEntry: InvalidEntrySkip, MinValidRatio: ratio(0.8)}, 4, ""},
+			{"warn", list, &DynamicCIDR{OnInvalidEntry: InvalidEntryWarn, MinValidRatio: ratio(0.8)}, 4, ""},
+			{"skip below the ratio", list, &DynamicCIDR{OnInvalidEntry: InvalidEntrySkip}, 0, "only 4 of 5 entries are valid"},
+			{"JSON skip", `["192.0.2.0/24", "192.0.2.0/33"]`, &DynamicCIDR{Format: FormatJSON, JSONPaths: []string{"[]"}, OnInvalidEntry: InvalidEntrySkip, MinValidRatio: ratio(0.5)}, 1, ""},
+			{"skip with the zero ratio", "broken\n192.0.2.0/24\nbroken too\n", &DynamicCIDR{OnInvalidEntry: InvalidEntrySkip, MinValidRatio: ratio(0)}, 1, ""},
+		}
+
+		for testId, test := range tests {
+			server := newListServer(t, test.content)
+			test.dynamicCIDR.Url = server.URL
+
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			if test.expected != "" {
+				t.Logf("\tTest %d: Whether the %s policy rejects the list with the error %q.", testId, test.name, test.expected)
+				require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+				continue
+			}
+
+			t.Logf("\tTest %d: Whether the %s policy accepts the list with %d subnets.", testId, test.name, test.total)
+			require.NoErrorf(t, err, "An error should not occur if enough entries are valid.")
+			require.Lenf(t, test.dynamicCIDR.cidrs(), test.total, "The valid entries should be kept.")
+		}
+	}
+
+	t.Log("Given the need to check that an invalid update keeps the previous list.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n198.51.100.0/24\n")
+		dyn := &DynamicCIDR{Url: server.URL}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		server.set("192.0.2.0/24\nbroken\n")
+		_, err = dyn.update()
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the previous list is kept.", testId)
+		require.ErrorContainsf(t, err, "invalid entry \"broken\" at line 2", "An error message should contain the line of the invalid entry.")
+		require.Lenf(t, dyn.cidrs(), 2, "The previous list should be kept.")
+		require.NotNilf(t, handler.(*ReverseGuard).lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP from the previous list should be trusted.")
+	}
+}
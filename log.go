@@ -3,54 +3,40 @@ package reverseguard
 import (
 	"fmt"
 	"os"
+	"sync"
 	"time"
 )
 
 var logChan chan string
 var errChan chan string
+var logOnce, errOnce sync.Once
 
-func writeOut(msg string) {
-	if logChan != nil {
-		logChan <- fmt.Sprintf("time=%q level=info msg=%q", time.Now().Format("2006-01-02T15:04:05Z"), msg) + "\n"
-		return
-	}
-
-	logChan = make(chan string)
+// startWriter creates the channel drained by the logging routine, so the callers don't wait for the output.
+func startWriter(out *os.File) chan string {
+	ch := make(chan string, 256)
 
 	// logging routine
 	go func() {
-		for {
-			select {
-			case msg := <-logChan:
-				_, _ = os.Stdout.WriteString(msg)
-			default:
-				time.Sleep(1 * time.Second)
-			}
+		for msg := range ch {
+			_, _ = out.WriteString(msg)
 		}
 	}()
 
-	writeOut(msg)
+	return ch
 }
 
-func writeErr(msg string) {
-	if errChan != nil {
-		errChan <- msg + "\n"
-		return
-	}
+func writeOut(msg string) {
+	logOnce.Do(func() {
+		logChan = startWriter(os.Stdout)
+	})
 
-	errChan = make(chan string)
+	logChan <- fmt.Sprintf("time=%q level=info msg=%q", time.Now().Format("2006-01-02T15:04:05Z"), msg) + "\n"
+}
 
-	// logging routine
-	go func() {
-		for {
-			select {
-			case msg := <-errChan:
-				_, _ = os.Stderr.WriteString(msg)
-			default:
-				time.Sleep(1 * time.Second)
-			}
-		}
-	}()
+func writeErr(msg string) {
+	errOnce.Do(func() {
+		errChan = startWriter(os.Stderr)
+	})
 
-	writeErr(msg)
+	errChan <- msg + "\n"
 }
@@ -7,9 +7,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"regexp"
-	"strconv"
-	"strings"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,31 +22,152 @@ type ReverseGuard struct {
 	next   http.Handler
 	name   string
 	config *Config
+
+	// index holds the *cidrTrie compiled from the current subnet lists. It is never modified once published,
+	// so the requests read it without locking while the refresh routines replace it as a whole.
+	index   atomic.Value
+	indexMu sync.Mutex // serializes the rebuilds
+
+	// subscriptions are the dynamic lists subscribed to the shared sources. They are released once the instance
+	// is replaced by another one of the same name, its context is done or its configuration is invalid.
+	subscriptions []*subscriber
+	released      chan struct{}
+	releaseOnce   sync.Once
+	// successor holds the *ReverseGuard which has replaced the instance. Traefik creates an instance per router
+	// of the middleware, so a replaced one keeps serving its router with the subnet lists of the successor.
+	successor atomic.Value
 }
 
-func (r *ReverseGuard) lookupTrustedSet(ip string) *ReverseProxy {
-	netIp := net.ParseIP(ip)
+func (r *ReverseGuard) lookupTrustedSet(ip net.IP) *ReverseProxy {
+	index, _ := r.index.Load().(*cidrTrie)
+	if index == nil {
+		return nil
+	}
+
+	return index.lookup(ip)
+}
+
+// rebuildIndex compiles the subnets of all the guards into a new prefix trie and publishes it.
+// It is called once the configuration is loaded and every time a dynamic subnet list is updated.
+func (r *ReverseGuard) rebuildIndex() {
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
+
+	index := newCIDRTrie(r.config.MatchStrategy)
 
 	for _, proxy := range r.config.Map {
-		if proxy.contains(netIp) {
-			return proxy
+		for _, cidr := range proxy.staticCIDRS {
+			index.insert(cidr, proxy)
+		}
+
+		for _, dynamicCIDR := range proxy.DynamicCIDRs {
+			for _, entry := range dynamicCIDR.cidrs() {
+				if entry.denied {
+					index.insertDeny(entry.cidr, proxy)
+					continue
+				}
+
+				index.insert(entry.cidr, proxy)
+			}
+		}
+
+		for _, cidr := range proxy.denyStaticCIDRs {
+			index.insertDeny(cidr, proxy)
+		}
+
+		for _, dynamicCIDR := range proxy.DenyDynamicCIDRs {
+			for _, entry := range dynamicCIDR.cidrs() {
+				index.insertDeny(entry.cidr, proxy)
+			}
 		}
 	}
 
-	return nil
+	r.index.Store(index)
 }
 
-func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+func New(ctx context.Context, next http.Handler, config *Config, name string) (_ http.Handler, err error) {
 	plugin := &ReverseGuard{
-		next:   next,
-		name:   name,
-		config: config,
+		next:     next,
+		name:     name,
+		config:   config,
+		released: make(chan struct{}),
+	}
+
+	// the sources subscribed before an error are not to be kept running
+	defer func() {
+		if err != nil {
+			plugin.release()
+		}
+	}()
+
+	if config.ClientIP != nil {
+		if config.ClientIP.Header == "" {
+			config.ClientIP.Header = HeaderXForwardedFor
+		}
+
+		config.ClientIP.Header = http.CanonicalHeaderKey(config.ClientIP.Header)
+
+		if len(config.ClientIP.RawTrustedCIDRs) == 0 {
+			return nil, errors.New("error in the client_ip configuration: no trusted hops (trusted_cidrs)")
+		}
+
+		for _, v := range config.ClientIP.RawTrustedCIDRs {
+			cidr, err := parseCIDR(v)
+			if err != nil {
+				return nil, fmt.Errorf("error in the client_ip configuration: the trusted CIDR %q is invalid", v)
+			}
+
+			config.ClientIP.trustedCIDRs = append(config.ClientIP.trustedCIDRs, cidr)
+		}
+
+		config.ClientIP.RawTrustedCIDRs = nil
+	}
+
+	if config.Admin != nil {
+		if err := config.Admin.init(); err != nil {
+			return nil, fmt.Errorf("error in the admin configuration: %s", err.Error())
+		}
+	}
+
+	if config.CacheDir != "" {
+		if err := os.MkdirAll(config.CacheDir, 0o700); err != nil {
+			return nil, fmt.Errorf("error in the cache_dir configuration: %s", err.Error())
+		}
+	}
+
+	config.cacheMaxAge = defaultCacheMaxAge
+
+	if config.RawCacheMaxAge != "" {
+		maxAge, err := time.ParseDuration(config.RawCacheMaxAge)
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("error in the cache_max_age configuration: invalid duration %q", config.RawCacheMaxAge)
+		}
+
+		config.cacheMaxAge = maxAge
+		config.RawCacheMaxAge = ""
+	}
+
+	switch config.MatchStrategy {
+	case "":
+		config.MatchStrategy = MatchPriority
+	case MatchPriority, MatchLongestPrefix:
+		// nop
+	default:
+		return nil, fmt.Errorf("the match strategy %q is not valid. Available strategies: %s, %s", config.MatchStrategy, MatchPriority, MatchLongestPrefix)
 	}
 
 	if len(config.Map) == 0 {
 		return nil, errors.New("empty configuration")
 	} else {
 		for name, proxy := range config.Map {
+			proxy.name = name
+
+			if proxy.Preset != "" {
+				if err := proxy.applyPreset(); err != nil {
+					return nil, err
+				}
+			}
+
 			if len(proxy.DynamicCIDRs) == 0 && len(proxy.RawStaticCIDRs) == 0 {
 				return nil, fmt.Errorf("error in %q reverse proxy configuration: no configured subnets (CIDRs). This middleware will not be used", name)
 			}
@@ -72,11 +193,7 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 			}
 
 			for _, v := range proxy.RawStaticCIDRs {
-				if !strings.Contains(v, "/") {
-					v += "/32"
-				}
-
-				_, cidr, err := net.ParseCIDR(v)
+				cidr, err := parseCIDR(v)
 				if err != nil {
 					return nil, fmt.Errorf("error in %q reverse proxy configuration: the static CIDR %q is invalid", name, v)
 				}
@@ -85,121 +202,387 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 			}
 
 			proxy.RawStaticCIDRs = nil
-			intervalRegex := regexp.MustCompile(`^(\d+)(s|h|d|w|m|M)$`)
 
-			for _, dynamicCIDR := range proxy.DynamicCIDRs {
-				_, err := url.ParseRequestURI(dynamicCIDR.Url)
+			for _, v := range proxy.RawDenyStaticCIDRs {
+				cidr, err := parseCIDR(v)
 				if err != nil {
-					return nil, fmt.Errorf("error in %q reverse proxy configuration: the url %q is invalid", name, dynamicCIDR.Url)
+					return nil, fmt.Errorf("error in %q reverse proxy configuration: the deny static CIDR %q is invalid", name, v)
 				}
 
-				if dynamicCIDR.RawInterval != "" {
-					matches := intervalRegex.FindAllStringSubmatch(dynamicCIDR.RawInterval, -1)
-					invalidIntervalError := fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: invalid interval %q", name, dynamicCIDR.Url, dynamicCIDR.RawInterval)
-
-					if len(matches) == 0 {
-						return nil, invalidIntervalError
-					}
-
-					number, err := strconv.Atoi(matches[0][1])
-					if err != nil {
-						return nil, invalidIntervalError
-					}
+				proxy.denyStaticCIDRs = append(proxy.denyStaticCIDRs, cidr)
+			}
 
-					interval, err := NewInterval(number, matches[0][2])
-					if err != nil {
-						return nil, fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
-					}
+			proxy.RawDenyStaticCIDRs = nil
 
-					dynamicCIDR.interval = interval
-					dynamicCIDR.RawInterval = ""
-				}
-
-				added, _, err := dynamicCIDR.update()
-				if err != nil {
-					return nil, fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+			for _, dynamicCIDR := range proxy.DynamicCIDRs {
+				if err := plugin.setupDynamicCIDR(name, proxy, dynamicCIDR, false); err != nil {
+					return nil, err
 				}
+			}
 
-				writeOut(fmt.Sprintf("Reverse proxy %q, endpoint %q has been updated. New number of subnets: %d", name, dynamicCIDR.Url, added))
-				writeOut(fmt.Sprintf("Reverse proxy %q, total number of subnets: %d", name, proxy.countCIDRs()))
-
-				if dynamicCIDR.interval != nil {
-					go func(dyn *DynamicCIDR, proxy *ReverseProxy) {
-						var timeUnit int
-
-						switch dyn.interval.Unit {
-						case "s":
-							timeUnit = int(time.Second)
-						case "m":
-							timeUnit = int(time.Minute)
-						case "h":
-							timeUnit = int(time.Hour)
-						case "d":
-							timeUnit = int(time.Hour * 24)
-						case "w":
-							timeUnit = int(time.Hour * 24 * 7)
-						}
-
-						interval := time.Duration(dyn.interval.Number * timeUnit)
-
-						writeOut(fmt.Sprintf(
-							"Reverse proxy %q, CIDR list syncing from endpoint %q is started. Interval %d%s. Next run at %s.",
-							name,
-							dyn.Url,
-							dyn.interval.Number,
-							dyn.interval.Unit,
-							time.Now().Add(interval).Format(time.RFC822),
-						))
-
-						for {
-							time.Sleep(interval)
-
-							added, _, err := dyn.update()
-							nextRun := time.Now().Add(interval).Format(time.RFC822)
-
-							if err != nil {
-								writeErr(fmt.Sprintf(
-									"Reverse proxy %q, failed to update subnet list at endpoint %q: %s. Next run at %s",
-									name,
-									dyn.Url,
-									err.Error(),
-									nextRun,
-								))
-							}
-
-							writeOut(fmt.Sprintf(
-								"Reverse proxy %q, endpoint %q has been succefully updated. New number of subnets: %d. Next run at %s",
-								name,
-								dyn.Url,
-								added,
-								nextRun,
-							))
-							writeOut(fmt.Sprintf("Reverse proxy %q, total number of subnets: %d", name, proxy.countCIDRs()))
-						}
-					}(dynamicCIDR, proxy)
+			for _, dynamicCIDR := range proxy.DenyDynamicCIDRs {
+				if err := plugin.setupDynamicCIDR(name, proxy, dynamicCIDR, true); err != nil {
+					return nil, err
 				}
 			}
 
-			writeOut(fmt.Sprintf("The reverse proxy %q is ready to go. Total number of IP subnets: %d.", name, proxy.countCIDRs()))
+			writeOut(fmt.Sprintf("The reverse proxy %q is ready to go. Total number of IP subnets: %d, denied: %d.", name, proxy.countCIDRs(), proxy.countDenyCIDRs()))
 		}
 	}
 
+	plugin.rebuildIndex()
+
+	registry.replace(plugin)
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				plugin.release()
+			case <-plugin.released:
+			}
+		}()
+	}
+
 	return plugin, nil
 }
 
+// release unsubscribes the dynamic lists of the instance from the shared sources. The syncing routine
+// of a source is stopped once it has no subscribers left.
+func (r *ReverseGuard) release() {
+	r.releaseOnce.Do(func() {
+		close(r.released)
+
+		registry.forget(r)
+
+		for _, sub := range r.subscriptions {
+			registry.unsubscribe(sub.key, sub)
+		}
+	})
+}
+
+// latest returns the instance which has replaced this one last, or this one if it has not been replaced.
+func (r *ReverseGuard) latest() *ReverseGuard {
+	for {
+		successor, _ := r.successor.Load().(*ReverseGuard)
+		if successor == nil {
+			return r
+		}
+
+		r = successor
+	}
+}
+
+// setupDynamicCIDR validates the dynamic subnet list and subscribes it to the shared source until the instance is released.
+// The source is loaded unless it is already used by another guard or middleware instance.
+func (r *ReverseGuard) setupDynamicCIDR(name string, proxy *ReverseProxy, dynamicCIDR *DynamicCIDR, deny bool) error {
+	_, err := url.ParseRequestURI(dynamicCIDR.Url)
+	if err != nil {
+		return fmt.Errorf("error in %q reverse proxy configuration: the url %q is invalid", name, dynamicCIDR.Url)
+	}
+
+	if dynamicCIDR.MaxBytes < 0 {
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the \"max_bytes\" option must not be negative", name, dynamicCIDR.Url)
+	}
+
+	if dynamicCIDR.MaxBytes == 0 {
+		dynamicCIDR.MaxBytes = defaultMaxBytes
+	}
+
+	dynamicCIDR.timeout = defaultTimeout
+
+	if dynamicCIDR.RawTimeout != "" {
+		timeout, err := time.ParseDuration(dynamicCIDR.RawTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: invalid timeout %q", name, dynamicCIDR.Url, dynamicCIDR.RawTimeout)
+		}
+
+		dynamicCIDR.timeout = timeout
+		dynamicCIDR.RawTimeout = ""
+	}
+
+	if dynamicCIDR.UserAgent == "" {
+		dynamicCIDR.UserAgent = defaultUserAgent
+	}
+
+	switch dynamicCIDR.Format {
+	case "":
+		dynamicCIDR.Format = FormatText
+	case FormatText:
+		// nop
+	case FormatJSON:
+		if len(dynamicCIDR.JSONPaths) == 0 {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the \"json_paths\" option is required for the %q format", name, dynamicCIDR.Url, FormatJSON)
+		}
+
+		for _, path := range dynamicCIDR.JSONPaths {
+			if _, err := splitJSONPath(path); err != nil {
+				return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+			}
+		}
+	default:
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the format %q is not valid. Available formats: %s, %s", name, dynamicCIDR.Url, dynamicCIDR.Format, FormatText, FormatJSON)
+	}
+
+	switch dynamicCIDR.OnInvalidEntry {
+	case "":
+		dynamicCIDR.OnInvalidEntry = InvalidEntryFail
+	case InvalidEntryFail, InvalidEntrySkip, InvalidEntryWarn:
+		// nop
+	default:
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the on_invalid_entry policy %q is not valid. Available policies: %s, %s, %s", name, dynamicCIDR.Url, dynamicCIDR.OnInvalidEntry, InvalidEntryFail, InvalidEntrySkip, InvalidEntryWarn)
+	}
+
+	dynamicCIDR.minValidRatio = defaultMinValidRatio
+
+	if ratio := dynamicCIDR.MinValidRatio; ratio != nil {
+		if *ratio < 0 || *ratio > 1 {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the \"min_valid_ratio\" option must be between 0 and 1", name, dynamicCIDR.Url)
+		}
+
+		dynamicCIDR.minValidRatio = *ratio
+	}
+
+	switch dynamicCIDR.OnExpiry {
+	case "":
+		dynamicCIDR.OnExpiry = ExpiryDrop
+		if deny {
+			dynamicCIDR.OnExpiry = ExpiryDeny
+		}
+	case ExpiryDrop, ExpiryDeny:
+		// nop
+	default:
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the on_expiry action %q is not valid. Available actions: %s, %s", name, dynamicCIDR.Url, dynamicCIDR.OnExpiry, ExpiryDrop, ExpiryDeny)
+	}
+
+	// dropping the expired entries of a deny list would let their IPs through
+	if deny && dynamicCIDR.OnExpiry == ExpiryDrop {
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the on_expiry action %q is not allowed in deny_dynamic_cidrs, the expired entries must stay denied", name, dynamicCIDR.Url, ExpiryDrop)
+	}
+
+	if dynamicCIDR.RawMaxStaleness != "" {
+		maxStaleness, err := time.ParseDuration(dynamicCIDR.RawMaxStaleness)
+		if err != nil || maxStaleness <= 0 {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: invalid max_staleness %q", name, dynamicCIDR.Url, dynamicCIDR.RawMaxStaleness)
+		}
+
+		dynamicCIDR.maxStaleness = maxStaleness
+		dynamicCIDR.RawMaxStaleness = ""
+	}
+
+	if dynamicCIDR.IntervalJitter < 0 || dynamicCIDR.IntervalJitter > 1 {
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the \"interval_jitter\" option must be between 0 and 1", name, dynamicCIDR.Url)
+	}
+
+	if dynamicCIDR.isDnsUrl() {
+		if _, _, err := dynamicCIDR.dnsQuery(); err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+
+		if dynamicCIDR.Format != FormatText || dynamicCIDR.Verify != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the \"format\" and \"verify\" options are not supported by dns sources", name, dynamicCIDR.Url)
+		}
+	}
+
+	if dynamicCIDR.DNSResolver != "" {
+		if _, _, err := net.SplitHostPort(dynamicCIDR.DNSResolver); err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the dns_resolver %q must be an address with a port, e.g. 10.0.0.53:53", name, dynamicCIDR.Url, dynamicCIDR.DNSResolver)
+		}
+	}
+
+	if dynamicCIDR.DNSMaxDepth < 0 {
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the \"dns_max_depth\" option must not be negative", name, dynamicCIDR.Url)
+	}
+
+	if dynamicCIDR.DNSMaxDepth == 0 {
+		dynamicCIDR.DNSMaxDepth = defaultDNSMaxDepth
+	}
+
+	for header, value := range dynamicCIDR.Headers {
+		if _, err := resolveHeader(header, value); err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+	}
+
+	if dynamicCIDR.TLS != nil {
+		if err := dynamicCIDR.TLS.init(); err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+	}
+
+	if dynamicCIDR.Verify != nil {
+		if err := dynamicCIDR.Verify.init(); err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+	}
+
+	if dynamicCIDR.Safeguards != nil {
+		if err := dynamicCIDR.Safeguards.init(); err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+	}
+
+	if dynamicCIDR.Retry != nil {
+		if err := dynamicCIDR.Retry.init(); err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+	}
+
+	dynamicCIDR.watchInterval = defaultWatchInterval
+
+	if dynamicCIDR.RawWatchInterval != "" {
+		watchInterval, err := time.ParseDuration(dynamicCIDR.RawWatchInterval)
+		if err != nil || watchInterval <= 0 {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: invalid watch_interval %q", name, dynamicCIDR.Url, dynamicCIDR.RawWatchInterval)
+		}
+
+		dynamicCIDR.watchInterval = watchInterval
+		dynamicCIDR.RawWatchInterval = ""
+	}
+
+	if dynamicCIDR.RawInterval != "" && dynamicCIDR.Schedule != "" {
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: the \"interval\" and \"schedule\" options are mutually exclusive", name, dynamicCIDR.Url)
+	}
+
+	if dynamicCIDR.RawInterval != "" {
+		interval, err := ParseInterval(dynamicCIDR.RawInterval)
+		if err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: invalid interval %q: %s", name, dynamicCIDR.Url, dynamicCIDR.RawInterval, err.Error())
+		}
+
+		dynamicCIDR.interval = interval
+		dynamicCIDR.RawInterval = ""
+	}
+
+	if dynamicCIDR.Schedule != "" {
+		schedule, err := parseSchedule(dynamicCIDR.Schedule)
+		if err != nil {
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+
+		dynamicCIDR.schedule = schedule
+	}
+
+	dynamicCIDR.cacheDir = r.config.CacheDir
+	dynamicCIDR.cacheMaxAge = r.config.cacheMaxAge
+
+	sub := &subscriber{
+		name:   name,
+		proxy:  proxy,
+		dyn:    dynamicCIDR,
+		plugin: r,
+	}
+
+	if err := registry.subscribe(sub); err != nil {
+		return err
+	}
+
+	r.subscriptions = append(r.subscriptions, sub)
+
+	return nil
+}
+
+// loadDynamicCIDR performs the initial load of the dynamic subnet list, falling back to the cached list if the source
+// is unavailable.
+func (r *ReverseGuard) loadDynamicCIDR(name string, proxy *ReverseProxy, dynamicCIDR *DynamicCIDR) error {
+	result, err := dynamicCIDR.update()
+	if err != nil {
+		if dynamicCIDR.cacheDir == "" {
+			if dynamicCIDR.snapshot != "" {
+				return r.loadSnapshot(name, proxy, dynamicCIDR, err)
+			}
+
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s", name, dynamicCIDR.Url, err.Error())
+		}
+
+		entry, cacheErr := dynamicCIDR.loadCache()
+		if cacheErr != nil {
+			if dynamicCIDR.snapshot != "" {
+				return r.loadSnapshot(name, proxy, dynamicCIDR, fmt.Errorf("%s. Cache fallback failed: %s", err.Error(), cacheErr.Error()))
+			}
+
+			return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s. Cache fallback failed: %s", name, dynamicCIDR.Url, err.Error(), cacheErr.Error())
+		}
+
+		writeErr(fmt.Sprintf(
+			"Reverse proxy %q, endpoint %q is unavailable: %s. The cached list fetched at %s is used instead. Number of subnets: %d",
+			name,
+			dynamicCIDR.Url,
+			err.Error(),
+			entry.FetchedAt.Format(time.RFC822),
+			len(dynamicCIDR.cidrs()),
+		))
+
+		// the cached list may have expired while Traefik was stopped
+		dynamicCIDR.expire()
+
+		result = &updateResult{total: len(dynamicCIDR.cidrs())}
+	}
+
+	writeOut(fmt.Sprintf("Reverse proxy %q, endpoint %q has been updated. New number of subnets: %d%s", name, dynamicCIDR.Url, result.total, result.summary()))
+	writeOut(fmt.Sprintf("Reverse proxy %q, total number of subnets: %d", name, proxy.countCIDRs()))
+
+	return nil
+}
+
+// loadSnapshot falls back to the list embedded in the preset of the unavailable source.
+func (r *ReverseGuard) loadSnapshot(name string, proxy *ReverseProxy, dynamicCIDR *DynamicCIDR, cause error) error {
+	if err := dynamicCIDR.loadSnapshot(); err != nil {
+		return fmt.Errorf("error in %q reverse proxy configuration, endpoint %q: %s. Snapshot fallback failed: %s", name, dynamicCIDR.Url, cause.Error(), err.Error())
+	}
+
+	writeErr(fmt.Sprintf(
+		"Reverse proxy %q, endpoint %q is unavailable: %s. The snapshot embedded in the preset %q is used instead. Number of subnets: %d",
+		name,
+		dynamicCIDR.Url,
+		cause.Error(),
+		proxy.Preset,
+		len(dynamicCIDR.cidrs()),
+	))
+	writeOut(fmt.Sprintf("Reverse proxy %q, total number of subnets: %d", name, proxy.countCIDRs()))
+
+	return nil
+}
+
 func (r *ReverseGuard) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	reverse := r.lookupTrustedSet(req.RemoteAddr[:strings.Index(req.RemoteAddr, ":")])
+	r.latest().serve(rw, req, r.next)
+}
 
-	if reverse == nil {
-		if r.config.Custom403Response.code != 0 {
-			http.Error(rw, r.config.Custom403Response.content, r.config.Custom403Response.code)
-		} else {
-			http.Error(rw, "", http.StatusForbidden)
+// serve guards the request by the configuration and the subnet lists of the instance and passes it to the next handler.
+func (r *ReverseGuard) serve(rw http.ResponseWriter, req *http.Request, next http.Handler) {
+	ip, err := parseRemoteAddr(req.RemoteAddr)
+	if err != nil {
+		r.forbid(rw)
+		return
+	}
+
+	if r.config.ClientIP != nil {
+		ip, err = r.config.ClientIP.resolve(ip, req.Header)
+		if err != nil {
+			r.forbid(rw)
+			return
 		}
+	}
+
+	if r.serveAdmin(rw, req, ip) {
+		return
+	}
 
+	reverse := r.lookupTrustedSet(ip)
+
+	if reverse == nil {
+		r.forbid(rw)
 		return
 	}
 
 	reverse.applyHeaderOptions(req)
-	r.next.ServeHTTP(rw, req)
+	next.ServeHTTP(rw, req)
+}
+
+func (r *ReverseGuard) forbid(rw http.ResponseWriter) {
+	if r.config.Custom403Response != nil && r.config.Custom403Response.code != 0 {
+		http.Error(rw, r.config.Custom403Response.content, r.config.Custom403Response.code)
+	} else {
+		http.Error(rw, "", http.StatusForbidden)
+	}
 }
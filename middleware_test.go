@@ -5,9 +5,39 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
+// listServer is a local HTTP server which serves a subnet list in the same way as https://www.cloudflare.com/ips-v4.
+type listServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	content string
+}
+
+func newListServer(t testing.TB, content string) *listServer {
+	server := &listServer{content: content}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		_, _ = rw.Write([]byte(server.content))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (s *listServer) set(content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.content = content
+}
+
 func TestConfigurationErrors(t *testing.T) {
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
@@ -214,13 +244,14 @@ func TestConfigurationErrors(t *testing.T) {
 		require.ErrorContainsf(t, err, "cloudflare", "An error message should contain a name of configuration in which an error occurred.")
 		require.ErrorContainsf(t, err, fmt.Sprintf("invalid interval %q", invalidInterval), "There should be an error if incorrect interval is specified in the dynamic_cidrs section.")
 
+		server := newListServer(t, "173.245.48.0/20\n103.21.244.0/22\n103.22.200.0/22\n")
 		items["cloudflare"] = &ReverseProxy{
 			DynamicCIDRs: []*DynamicCIDR{
-				{Url: "https://www.cloudflare.com/ips-v4", RawInterval: "60s"},
-				{Url: "https://www.cloudflare.com/ips-v4", RawInterval: "60m"},
-				{Url: "https://www.cloudflare.com/ips-v4", RawInterval: "60h"},
-				{Url: "https://www.cloudflare.com/ips-v4", RawInterval: "60d"},
-				{Url: "https://www.cloudflare.com/ips-v4", RawInterval: "60w"},
+				{Url: server.URL, RawInterval: "60s"},
+				{Url: server.URL, RawInterval: "60m"},
+				{Url: server.URL, RawInterval: "60h"},
+				{Url: server.URL, RawInterval: "60d"},
+				{Url: server.URL, RawInterval: "60w"},
 				// &DynamicCIDR{Url: "file:///var/log/dynip.txt", RawInterval: "60w"}, TODO : Add tests for local file url
 			},
 		}
@@ -234,3 +265,223 @@ func TestConfigurationErrors(t *testing.T) {
 
 	}
 }
+
+func TestMatchStrategy(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the match_strategy option.")
+	{
+		items := map[string]*ReverseProxy{"cloudflare": {RawStaticCIDRs: []string{"10.0.0.0/8"}}}
+
+		_, err := New(context.Background(), next, &Config{Map: items, MatchStrategy: "random"}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an error occurs if the match strategy is unknown.", testId)
+		require.ErrorContainsf(t, err, "match strategy \"random\" is not valid", "An error message should contain information about the invalid match strategy.")
+	}
+
+	t.Log("Given the need to check that the header actions of the chosen guard are applied.")
+	{
+		var realIP string
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			realIP = req.Header.Get("X-Real-Ip")
+		})
+
+		items := map[string]*ReverseProxy{
+			"cloudflare": {
+				Priority:       10,
+				RawStaticCIDRs: []string{"10.0.0.0/8"},
+				HeaderActions:  []*HeaderAction{{Action: ActionCopy, Source: "Cf-Connecting-Ip", Target: "X-Real-Ip"}},
+			},
+			"internal": {
+				RawStaticCIDRs: []string{"10.13.0.0/16"},
+				HeaderActions:  []*HeaderAction{{Action: ActionCopy, Source: "X-Forwarded-For", Target: "X-Real-Ip"}},
+			},
+		}
+
+		handler, err := New(context.Background(), next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		t.Logf("\tTest %d: Whether the header actions of the guard with the highest priority are always applied.", 0)
+
+		for i := 0; i < 20; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = "10.13.0.1:1234"
+			req.Header.Set("Cf-Connecting-Ip", "192.0.2.1")
+			req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			require.Equalf(t, "192.0.2.1", realIP, "The header actions of the \"cloudflare\" guard should be applied.")
+		}
+	}
+}
+
+func TestDenyLists(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in deny_static_cidrs sections.")
+	{
+		invalidSubnet := "10.13.0.0/33"
+		items := make(map[string]*ReverseProxy, 1)
+		items["cloudflare"] = &ReverseProxy{
+			RawStaticCIDRs:     []string{"10.0.0.0/8"},
+			RawDenyStaticCIDRs: []string{invalidSubnet},
+		}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an error in the deny_static_cidrs section contains information about invalid CIDR/subnet.", testId)
+		require.ErrorContainsf(t, err, "cloudflare", "An error message should contain a name of configuration in which an error occurred.")
+		require.ErrorContainsf(t, err, fmt.Sprintf("%q is invalid", invalidSubnet), "An error message should contain information about invalid CIDR/subnet.")
+
+		testId++
+
+		items["cloudflare"] = &ReverseProxy{
+			RawDenyStaticCIDRs: []string{"10.13.0.0/16"},
+		}
+
+		_, err = New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		t.Logf("\tTest %d: Whether an error occurs if a guard has denied subnets only.", testId)
+		require.ErrorContainsf(t, err, "no configured subnets", "An error message should contain the main idea.")
+	}
+
+	t.Log("Given the need to check that the denied subnets are excluded from the trusted ones.")
+	{
+		server := newListServer(t, "10.13.7.0/24\n")
+		items := make(map[string]*ReverseProxy, 1)
+		items["cloudflare"] = &ReverseProxy{
+			RawStaticCIDRs:     []string{"10.0.0.0/8"},
+			RawDenyStaticCIDRs: []string{"10.13.0.0/16"},
+			DenyDynamicCIDRs: []*DynamicCIDR{
+				{Url: server.URL},
+			},
+		}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		tests := []struct {
+			remoteAddr string
+			code       int
+		}{
+			{"10.1.0.1:1234", http.StatusOK},
+			{"10.13.0.1:1234", http.StatusForbidden},
+			{"10.13.7.1:1234", http.StatusForbidden},
+		}
+
+		for testId, test := range tests {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = test.remoteAddr
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			t.Logf("\tTest %d: Whether the request from %q gets the %d code.", testId, test.remoteAddr, test.code)
+			require.Equalf(t, test.code, rec.Code, "The request from %q should get the %d code.", test.remoteAddr, test.code)
+		}
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	t.Log("Given the need to check that the requests are served consistently while the lists are refreshed.")
+	{
+		listA, listB := "192.0.2.0/24\n", "198.51.100.0/24\n"
+		server := newListServer(t, listA)
+
+		items := map[string]*ReverseProxy{
+			"static":  {RawStaticCIDRs: []string{"203.0.113.0/24"}},
+			"dynamic": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL}, {Url: server.URL}}},
+		}
+
+		handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+		stop := make(chan struct{})
+		failures := make(chan string, 100)
+
+		var wg sync.WaitGroup
+
+		// the refresh routines
+		for _, dyn := range items["dynamic"].DynamicCIDRs {
+			wg.Add(1)
+
+			go func(dyn *DynamicCIDR) {
+				defer wg.Done()
+
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					if i%2 == 0 {
+						server.set(listB)
+					} else {
+						server.set(listA)
+					}
+
+					if _, err := dyn.update(); err != nil {
+						failures <- err.Error()
+						return
+					}
+
+					plugin.rebuildIndex()
+				}
+			}(dyn)
+		}
+
+		// the request routines
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					for remoteAddr, allowed := range map[string][]int{
+						"203.0.113.1:1234":  {http.StatusOK},
+						"192.0.2.1:1234":    {http.StatusOK, http.StatusForbidden},
+						"198.51.100.1:1234": {http.StatusOK, http.StatusForbidden},
+						"10.0.0.1:1234":     {http.StatusForbidden},
+					} {
+						req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+						req.RemoteAddr = remoteAddr
+						rec := httptest.NewRecorder()
+
+						handler.ServeHTTP(rec, req)
+
+						if rec.Code != allowed[0] && (len(allowed) == 1 || rec.Code != allowed[1]) {
+							failures <- fmt.Sprintf("the request from %q got the %d code", remoteAddr, rec.Code)
+							return
+						}
+					}
+				}
+			}()
+		}
+
+		time.Sleep(500 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+		close(failures)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether all the requests got the expected codes and the refreshes succeeded.", testId)
+		for failure := range failures {
+			require.Failf(t, "Unexpected result", "%s", failure)
+		}
+	}
+}
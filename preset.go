@@ -0,0 +1,278 @@
+package reverseguard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The presets bundle the subnet sources and the header actions of the common CDNs and DDoS shields.
+// Every source of a preset comes with a snapshot of its list, which is used if the source is unavailable
+// when Traefik starts and no cached list is available. The providers without a machine-readable list
+// are covered by the snapshot alone, as static subnets.
+
+const (
+	PresetCloudflare       = "cloudflare"
+	PresetFastly           = "fastly"
+	PresetCloudFront       = "cloudfront"
+	PresetAkamaiSiteShield = "akamai-siteshield"
+	PresetStormWall        = "stormwall"
+	PresetDDoSGuard        = "ddos-guard"
+	PresetGCPLoadBalancer  = "gcp-lb"
+	PresetBunny            = "bunny"
+)
+
+const presetInterval = "12h"
+
+const cloudflareV4Snapshot = `
+173.245.48.0/20
+103.21.244.0/22
+103.22.200.0/22
+103.31.4.0/22
+141.101.64.0/18
+108.162.192.0/18
+190.93.240.0/20
+188.114.96.0/20
+197.234.240.0/22
+198.41.128.0/17
+162.158.0.0/15
+104.16.0.0/13
+104.24.0.0/14
+172.64.0.0/13
+131.0.72.0/22
+`
+
+const cloudflareV6Snapshot = `
+2400:cb00::/32
+2606:4700::/32
+2803:f800::/32
+2405:b500::/32
+2405:8100::/32
+2a06:98c0::/29
+2c0f:f248::/32
+`
+
+const fastlySnapshot = `
+23.235.32.0/20
+43.249.72.0/22
+103.244.50.0/24
+103.245.222.0/23
+103.245.224.0/24
+104.156.80.0/20
+140.248.64.0/18
+140.248.128.0/17
+146.75.0.0/17
+151.101.0.0/16
+157.52.64.0/18
+167.82.0.0/17
+167.82.128.0/20
+167.82.160.0/20
+167.82.224.0/20
+172.111.64.0/18
+185.31.16.0/22
+199.27.72.0/21
+199.232.0.0/16
+2a04:4e40::/32
+2a04:4e42::/32
+`
+
+const cloudFrontSnapshot = `
+3.160.0.0/14
+13.32.0.0/15
+13.35.0.0/16
+13.224.0.0/14
+13.249.0.0/16
+18.64.0.0/14
+18.160.0.0/15
+18.164.0.0/15
+18.172.0.0/15
+52.84.0.0/15
+54.182.0.0/16
+54.192.0.0/16
+54.230.0.0/16
+54.239.128.0/18
+64.252.64.0/18
+65.8.0.0/16
+65.9.0.0/17
+70.132.0.0/18
+71.152.0.0/17
+99.84.0.0/16
+108.156.0.0/14
+143.204.0.0/16
+204.246.164.0/22
+205.251.192.0/19
+216.137.32.0/19
+2600:9000::/28
+`
+
+const stormWallSnapshot = `
+193.84.78.0/24
+185.121.240.0/22
+188.0.150.0/24
+103.134.155.0/24
+`
+
+const ddosGuardSnapshot = `
+186.2.160.0/20
+190.115.16.0/20
+185.178.208.0/22
+`
+
+// The proxies and the health checkers of the Google Cloud external Application Load Balancers.
+const gcpLoadBalancerSnapshot = `
+35.191.0.0/16
+130.211.0.0/22
+2600:2d00:1:1::/64
+2600:2d00:1:b029::/64
+`
+
+type preset struct {
+	sources []*presetSource
+	// staticCIDRs are trusted as is, since the provider publishes no machine-readable list.
+	staticCIDRs   string
+	headerActions []*HeaderAction
+	// required is the explanation for the presets which need the subnets configured by the user.
+	required string
+}
+
+type presetSource struct {
+	url        string
+	format     string
+	jsonPaths  []string
+	jsonFilter map[string]string
+	headers    map[string]string
+	interval   string
+	snapshot   string
+}
+
+var presets = map[string]*preset{
+	PresetCloudflare: {
+		sources: []*presetSource{
+			{url: "https://www.cloudflare.com/ips-v4", snapshot: cloudflareV4Snapshot},
+			{url: "https://www.cloudflare.com/ips-v6", snapshot: cloudflareV6Snapshot},
+		},
+		headerActions: []*HeaderAction{{Action: ActionCopy, Source: "cf-connecting-ip", Target: "x-real-ip"}},
+	},
+	PresetFastly: {
+		sources: []*presetSource{{
+			url:       "https://api.fastly.com/public-ip-list",
+			format:    FormatJSON,
+			jsonPaths: []string{"addresses[]", "ipv6_addresses[]"},
+			snapshot:  fastlySnapshot,
+		}},
+		headerActions: []*HeaderAction{{Action: ActionCopy, Source: "fastly-client-ip", Target: "x-real-ip"}},
+	},
+	// CloudFront has no header holding the bare client IP (CloudFront-Viewer-Address holds the port as well),
+	// so the client_ip section is the way to take it from X-Forwarded-For.
+	PresetCloudFront: {
+		sources: []*presetSource{{
+			url:        "https://ip-ranges.amazonaws.com/ip-ranges.json",
+			format:     FormatJSON,
+			jsonPaths:  []string{"prefixes[].ip_prefix", "ipv6_prefixes[].ipv6_prefix"},
+			jsonFilter: map[string]string{"service": "CLOUDFRONT"},
+			snapshot:   cloudFrontSnapshot,
+		}},
+	},
+	// The Site Shield maps are specific to the customer and are only available from the Akamai API.
+	PresetAkamaiSiteShield: {
+		headerActions: []*HeaderAction{{Action: ActionCopy, Source: "true-client-ip", Target: "x-real-ip"}},
+		required:      "the Site Shield map is specific to the Akamai account, so its subnets must be set in \"static_cidrs\" or \"dynamic_cidrs\"",
+	},
+	PresetStormWall: {
+		staticCIDRs: stormWallSnapshot,
+	},
+	PresetDDoSGuard: {
+		staticCIDRs: ddosGuardSnapshot,
+	},
+	PresetGCPLoadBalancer: {
+		staticCIDRs: gcpLoadBalancerSnapshot,
+	},
+	// No snapshot of the edge server lists is embedded yet, so the cache_dir is the only fallback.
+	PresetBunny: {
+		sources: []*presetSource{
+			{url: "https://bunnycdn.com/api/system/edgeserverlist", format: FormatJSON, jsonPaths: []string{"[]"}, headers: map[string]string{"Accept": "application/json"}, interval: "1h"},
+			{url: "https://bunnycdn.com/api/system/edgeserverlist/IPv6", format: FormatJSON, jsonPaths: []string{"[]"}, headers: map[string]string{"Accept": "application/json"}, interval: "1h"},
+		},
+	},
+}
+
+// presetNames returns the names of the available presets, sorted.
+func presetNames() string {
+	var names []string
+
+	for name := range presets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// applyPreset adds the sources and the static subnets of the preset to the guard. The header actions
+// of the preset are used unless the guard has its own ones.
+func (r *ReverseProxy) applyPreset() error {
+	p, ok := presets[r.Preset]
+	if !ok {
+		return fmt.Errorf("error in %q reverse proxy configuration: the preset %q is not valid. Available presets: %s", r.name, r.Preset, presetNames())
+	}
+
+	if p.required != "" && len(r.DynamicCIDRs) == 0 && len(r.RawStaticCIDRs) == 0 {
+		return fmt.Errorf("error in %q reverse proxy configuration: the preset %q needs subnets: %s", r.name, r.Preset, p.required)
+	}
+
+	for _, source := range p.sources {
+		interval := source.interval
+		if interval == "" {
+			interval = presetInterval
+		}
+
+		r.DynamicCIDRs = append(r.DynamicCIDRs, &DynamicCIDR{
+			Url:            source.url,
+			RawInterval:    interval,
+			Format:         source.format,
+			JSONPaths:      source.jsonPaths,
+			JSONFilter:     source.jsonFilter,
+			Headers:        source.headers,
+			IntervalJitter: 0.1,
+			Safeguards:     &Safeguards{RejectReserved: true},
+			snapshot:       source.snapshot,
+		})
+	}
+
+	if p.staticCIDRs != "" {
+		entries, _, _ := parseTextList([]byte(p.staticCIDRs))
+
+		for _, entry := range entries {
+			r.RawStaticCIDRs = append(r.RawStaticCIDRs, entry.cidr.String())
+		}
+	}
+
+	if len(r.HeaderActions) == 0 {
+		for _, act := range p.headerActions {
+			r.HeaderActions = append(r.HeaderActions, &HeaderAction{Action: act.Action, Source: act.Source, Target: act.Target})
+		}
+	}
+
+	return nil
+}
+
+// loadSnapshot replaces the subnet list with the snapshot embedded in the preset of the source.
+func (d *DynamicCIDR) loadSnapshot() error {
+	entries, _, invalid := parseTextList([]byte(d.snapshot))
+	if len(invalid) > 0 {
+		return fmt.Errorf("the snapshot is invalid: %s", invalid[0].Error())
+	}
+
+	var CIDRList []cidrEntry
+
+	for _, entry := range entries {
+		CIDRList = append(CIDRList, cidrEntry{cidr: entry.cidr, origin: d.Url})
+	}
+
+	d.setCIDRs(CIDRList)
+	d.refreshedAt = time.Now()
+
+	return nil
+}
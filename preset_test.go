@@ -0,0 +1,112 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the preset option.")
+	{
+		tests := []struct {
+			proxy    *ReverseProxy
+			expected string
+		}{
+			{&ReverseProxy{Preset: "akamai"}, "the preset \"akamai\" is not valid. Available presets: akamai-siteshield, bunny"},
+			{&ReverseProxy{Preset: PresetAkamaiSiteShield}, "the Site Shield map is specific to the Akamai account"},
+		}
+
+		for testId, test := range tests {
+			_, err := New(ctx, next, &Config{Map: map[string]*ReverseProxy{"cdn": test.proxy}}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "cdn", "An error message should contain a name of configuration in which an error occurred.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the snapshots embedded in the presets.")
+	{
+		testId := 0
+
+		t.Logf("\tTest %d: Whether every snapshot is a valid subnet list.", testId)
+
+		for name, p := range presets {
+			snapshots := []string{p.staticCIDRs}
+			for _, source := range p.sources {
+				snapshots = append(snapshots, source.snapshot)
+			}
+
+			for _, snapshot := range snapshots {
+				_, _, invalid := parseTextList([]byte(snapshot))
+				require.Emptyf(t, invalid, "The snapshot of the preset %q should be valid.", name)
+			}
+		}
+	}
+
+	t.Log("Given the need to check the presets without a machine-readable list.")
+	{
+		items := map[string]*ReverseProxy{
+			"stormwall": {Preset: PresetStormWall},
+			"akamai":    {Preset: PresetAkamaiSiteShield, RawStaticCIDRs: []string{"192.0.2.0/24"}},
+		}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the static subnets of the preset are trusted.", testId)
+		require.Equalf(t, items["stormwall"], plugin.lookupTrustedSet(net.ParseIP("193.84.78.1")), "The IP should be trusted by the preset.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether the header actions of the preset are used.", testId)
+		require.Lenf(t, items["akamai"].HeaderActions, 1, "The header action of the preset should be added.")
+		require.Equalf(t, "true-client-ip", items["akamai"].HeaderActions[0].Source, "The real-client-IP header of the provider should be copied.")
+	}
+
+	t.Log("Given the need to check the snapshot fallback of an unavailable preset source.")
+	{
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(server.Close)
+
+		presets["test"] = &preset{
+			sources:       []*presetSource{{url: server.URL, snapshot: "# a snapshot\n192.0.2.0/24\n2001:db8::/32\n"}},
+			headerActions: []*HeaderAction{{Action: ActionCopy, Source: "x-client-ip", Target: "x-real-ip"}},
+		}
+		defer delete(presets, "test")
+
+		ownActions := []*HeaderAction{{Action: ActionDelete, Source: "x-client-ip"}}
+		items := map[string]*ReverseProxy{"cdn": {Preset: "test", HeaderActions: ownActions}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the snapshot is used if the source is unavailable.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the snapshot is available.")
+
+		plugin := handler.(*ReverseGuard)
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")), "The IPv4 of the snapshot should be trusted.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("2001:db8::1")), "The IPv6 of the snapshot should be trusted.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether the own header actions take precedence over the preset.", testId)
+		require.Equalf(t, ownActions, items["cdn"].HeaderActions, "The header actions of the preset should not be added.")
+	}
+}
@@ -0,0 +1,311 @@
+package reverseguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = time.Second
+	defaultRetryMaxBackoff     = time.Minute
+	defaultWatchInterval       = 2 * time.Second
+)
+
+// jitterRand is seeded explicitly, so Traefik instances started at once don't share the same sequence.
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterMu sync.Mutex
+
+// withJitter randomizes the duration by the fraction: the result is uniformly distributed
+// between d*(1-fraction) and d*(1+fraction).
+func withJitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+
+	jitterMu.Lock()
+	factor := 1 + fraction*(2*jitterRand.Float64()-1)
+	jitterMu.Unlock()
+
+	return time.Duration(float64(d) * factor)
+}
+
+// init validates the retry options and fills in the defaults.
+func (r *Retry) init() error {
+	if r.MaxAttempts < 0 {
+		return errors.New("the \"retry.max_attempts\" option must not be negative")
+	}
+
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = defaultRetryMaxAttempts
+	}
+
+	r.initialBackoff = defaultRetryInitialBackoff
+
+	if r.RawInitialBackoff != "" {
+		backoff, err := time.ParseDuration(r.RawInitialBackoff)
+		if err != nil || backoff <= 0 {
+			return fmt.Errorf("invalid retry.initial_backoff %q", r.RawInitialBackoff)
+		}
+
+		r.initialBackoff = backoff
+		r.RawInitialBackoff = ""
+	}
+
+	r.maxBackoff = defaultRetryMaxBackoff
+
+	if r.RawMaxBackoff != "" {
+		backoff, err := time.ParseDuration(r.RawMaxBackoff)
+		if err != nil || backoff <= 0 {
+			return fmt.Errorf("invalid retry.max_backoff %q", r.RawMaxBackoff)
+		}
+
+		r.maxBackoff = backoff
+		r.RawMaxBackoff = ""
+	}
+
+	if r.maxBackoff < r.initialBackoff {
+		return errors.New("the \"retry.max_backoff\" option must not be less than \"retry.initial_backoff\"")
+	}
+
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return errors.New("the \"retry.jitter\" option must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// updateWithRetry updates the dynamic list, repeating the failed attempts with an exponential backoff.
+// The waiting is interrupted once the context is done.
+func updateWithRetry(ctx context.Context, dyn *DynamicCIDR) (*updateResult, error) {
+	if dyn.Retry == nil {
+		return dyn.update()
+	}
+
+	backoff := dyn.Retry.initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		result, err := dyn.update()
+		if err == nil || attempt >= dyn.Retry.MaxAttempts {
+			return result, err
+		}
+
+		delay := withJitter(backoff, dyn.Retry.Jitter)
+
+		writeErr(fmt.Sprintf(
+			"Endpoint %q, attempt %d/%d to update subnet list failed: %s. Retrying in %s",
+			dyn.Url,
+			attempt,
+			dyn.Retry.MaxAttempts,
+			err.Error(),
+			delay.Round(time.Millisecond),
+		))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if backoff > dyn.Retry.maxBackoff {
+			backoff = dyn.Retry.maxBackoff
+		}
+	}
+}
+
+// run updates the dynamic list of the source by the shortest interval and by the schedules of its subscribers,
+// and fans the changes out to them, until the context is done. The schedule is recalculated whenever the subscribers change.
+// File sources are also watched for changes regardless of the interval. The expired entries are dropped
+// or denied as soon as they expire.
+func (p *poller) run(ctx context.Context) {
+	defer close(p.done)
+
+	dyn := p.source
+	lastRun := time.Now()
+
+	var watch <-chan time.Time
+	var watchErr string
+
+	if dyn.isFileUrl() {
+		ticker := time.NewTicker(dyn.watchInterval)
+		defer ticker.Stop()
+
+		watch = ticker.C
+	}
+
+	var interval time.Duration
+	var next time.Time
+	var schedules string
+
+	// nextRun is the earlier of the next interval run and the next scheduled run, zero if there is none
+	nextRun := func() time.Time {
+		at, _ := p.nextScheduled(lastRun)
+		if interval > 0 && (at.IsZero() || next.Before(at)) {
+			at = next
+		}
+
+		return at
+	}
+
+	for {
+		newInterval, jitter := p.schedule()
+
+		if newInterval != interval {
+			interval = newInterval
+
+			if interval > 0 {
+				next = lastRun.Add(withJitter(interval, jitter))
+
+				writeOut(fmt.Sprintf(
+					"CIDR list syncing from endpoint %q is scheduled. Interval %s. Next run at %s.",
+					dyn.Url,
+					interval,
+					nextRun().Format(time.RFC822),
+				))
+			}
+		}
+
+		if scheduled, newSchedules := p.nextScheduled(lastRun); strings.Join(newSchedules, ", ") != schedules {
+			schedules = strings.Join(newSchedules, ", ")
+
+			if schedules != "" {
+				writeOut(fmt.Sprintf(
+					"CIDR list syncing from endpoint %q is scheduled. Schedule %s (UTC). Next scheduled run at %s.",
+					dyn.Url,
+					schedules,
+					scheduled.Format(time.RFC822),
+				))
+			}
+		}
+
+		var timer, expiryTimer *time.Timer
+		var fire, expiry <-chan time.Time
+
+		if at := nextRun(); !at.IsZero() {
+			timer = time.NewTimer(time.Until(at))
+			fire = timer.C
+		}
+
+		if at := dyn.nextExpiry(); !at.IsZero() {
+			expiryTimer = time.NewTimer(time.Until(at))
+			expiry = expiryTimer.C
+		}
+
+		rescheduled, watched, expired := false, false, false
+
+		select {
+		case <-ctx.Done():
+		case <-p.reschedule:
+			rescheduled = true
+		case <-watch:
+			watched = true
+		case <-expiry:
+			expired = true
+		case <-fire:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if expiryTimer != nil {
+			expiryTimer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			writeOut(fmt.Sprintf("CIDR list syncing from endpoint %q is stopped.", dyn.Url))
+
+			return
+		}
+
+		if rescheduled {
+			continue
+		}
+
+		if watched {
+			watchErr = p.watchFile(watchErr)
+			continue
+		}
+
+		if expired {
+			if dyn.expire() {
+				p.publish()
+			}
+
+			continue
+		}
+
+		result, err := updateWithRetry(ctx, dyn)
+		lastRun = time.Now()
+		next = lastRun.Add(withJitter(interval, jitter))
+		nextRunAt := nextRun().Format(time.RFC822)
+
+		if ctx.Err() != nil {
+			continue
+		}
+
+		if err != nil {
+			writeErr(fmt.Sprintf(
+				"Endpoint %q, failed to update subnet list: %s. Next run at %s",
+				dyn.Url,
+				err.Error(),
+				nextRunAt,
+			))
+
+			continue
+		}
+
+		if result.unchanged {
+			writeOut(fmt.Sprintf(
+				"Endpoint %q is unchanged. Number of subnets: %d. Next run at %s",
+				dyn.Url,
+				result.total,
+				nextRunAt,
+			))
+
+			continue
+		}
+
+		writeOut(fmt.Sprintf(
+			"Endpoint %q has been succefully updated. New number of subnets: %d%s. Next run at %s",
+			dyn.Url,
+			result.total,
+			result.summary(),
+			nextRunAt,
+		))
+
+		p.publish()
+	}
+}
+
+// watchFile re-reads the file source if it has changed and fans the new list out to the subscribers.
+// A failure is logged once until the error changes, since the file is checked every few seconds.
+// It returns the error message of the check, if any.
+func (p *poller) watchFile(lastErr string) string {
+	dyn := p.source
+
+	result, err := dyn.update()
+	if err != nil {
+		if err.Error() != lastErr {
+			writeErr(fmt.Sprintf("Endpoint %q, failed to reload the changed file: %s", dyn.Url, err.Error()))
+		}
+
+		return err.Error()
+	}
+
+	if result.unchanged {
+		return ""
+	}
+
+	writeOut(fmt.Sprintf("Endpoint %q has been changed and reloaded. New number of subnets: %d%s", dyn.Url, result.total, result.summary()))
+
+	p.publish()
+
+	return ""
+}
@@ -0,0 +1,179 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the retry options of dynamic_cidrs sections.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: server.URL, IntervalJitter: 1.5}, "\"interval_jitter\" option must be between 0 and 1"},
+			{&DynamicCIDR{Url: server.URL, Retry: &Retry{MaxAttempts: -1}}, "\"retry.max_attempts\" option must not be negative"},
+			{&DynamicCIDR{Url: server.URL, Retry: &Retry{RawInitialBackoff: "1x"}}, "invalid retry.initial_backoff \"1x\""},
+			{&DynamicCIDR{Url: server.URL, Retry: &Retry{RawMaxBackoff: "0s"}}, "invalid retry.max_backoff \"0s\""},
+			{&DynamicCIDR{Url: server.URL, Retry: &Retry{RawInitialBackoff: "1m", RawMaxBackoff: "1s"}}, "must not be less than"},
+			{&DynamicCIDR{Url: server.URL, Retry: &Retry{Jitter: -0.1}}, "\"retry.jitter\" option must be between 0 and 1"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "partner", "An error message should contain a name of configuration in which an error occurred.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the randomization of the delays.")
+	{
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the randomized delays stay within the jitter bounds.", testId)
+
+		for i := 0; i < 1000; i++ {
+			d := withJitter(time.Minute, 0.1)
+			require.Truef(t, d >= 54*time.Second && d <= 66*time.Second, "The delay %s should be within ±10%% of a minute.", d)
+		}
+
+		testId++
+
+		t.Logf("\tTest %d: Whether the delay is not randomized without a jitter.", testId)
+		require.Equalf(t, time.Minute, withJitter(time.Minute, 0), "The delay should not be randomized.")
+	}
+
+	t.Log("Given the need to check the repeated attempts of a failed refresh.")
+	{
+		var requests, failures int32
+
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&failures) {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			_, _ = rw.Write([]byte("192.0.2.0/24\n"))
+		}))
+		t.Cleanup(server.Close)
+
+		dyn := &DynamicCIDR{Url: server.URL, Retry: &Retry{RawInitialBackoff: "10ms", RawMaxBackoff: "20ms"}}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failures, 2)
+
+		result, err := updateWithRetry(ctx, dyn)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the refresh succeeds after the failed attempts.", testId)
+		require.NoErrorf(t, err, "The refresh should succeed on the third attempt.")
+		require.Equalf(t, 1, result.total, "The list should be loaded.")
+		require.EqualValuesf(t, 3, atomic.LoadInt32(&requests), "The source should be requested three times.")
+
+		testId++
+
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failures, 5)
+
+		_, err = updateWithRetry(ctx, dyn)
+
+		t.Logf("\tTest %d: Whether the refresh fails once the attempts are exhausted.", testId)
+		require.ErrorContainsf(t, err, "response code 503", "The error of the last attempt should be returned.")
+		require.EqualValuesf(t, defaultRetryMaxAttempts, atomic.LoadInt32(&requests), "The source should be requested %d times.", defaultRetryMaxAttempts)
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the watch options of dynamic_cidrs sections.")
+	{
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: "file:///dev/null", RawWatchInterval: "often"}}}}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an error occurs if the watch interval is invalid.", testId)
+		require.ErrorContainsf(t, err, "invalid watch_interval \"often\"", "An error message should contain information about the invalid watch interval.")
+	}
+
+	t.Log("Given the need to check that the changes of file sources are picked up promptly.")
+	{
+		path := filepath.Join(t.TempDir(), "trusted.txt")
+		require.NoErrorf(t, os.WriteFile(path, []byte("192.0.2.0/24\n198.51.100.0/24\n"), 0o600), "The file should be writable.")
+
+		dyn := &DynamicCIDR{Url: "file://" + path, RawWatchInterval: "20ms"}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		result, err := dyn.update()
+
+		t.Logf("\tTest %d: Whether the unchanged file is not read again.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the file is unchanged.")
+		require.Truef(t, result.unchanged, "The file should be reported as unchanged.")
+		require.Lenf(t, dyn.cidrs(), 2, "The list should not be duplicated.")
+
+		testId++
+
+		require.NoErrorf(t, os.WriteFile(path, []byte("192.0.2.0/24\n"), 0o600), "The file should be writable.")
+
+		t.Logf("\tTest %d: Whether a dropped line revokes the trust without an interval.", testId)
+		require.Eventuallyf(t, func() bool {
+			return plugin.lookupTrustedSet(net.ParseIP("198.51.100.1")) == nil
+		}, 2*time.Second, 10*time.Millisecond, "The IP of the dropped line should not be trusted.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")), "The IP of the remaining line should be trusted.")
+		require.Lenf(t, dyn.cidrs(), 1, "The list should be replaced as a whole.")
+
+		testId++
+
+		require.NoErrorf(t, os.WriteFile(path, []byte("192.0.2.0/24\nbroken\n"), 0o600), "The file should be writable.")
+		time.Sleep(200 * time.Millisecond)
+
+		t.Logf("\tTest %d: Whether the invalid file keeps the previous list.", testId)
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")), "The previous list should be kept.")
+
+		testId++
+
+		replacement := path + ".new"
+		require.NoErrorf(t, os.WriteFile(replacement, []byte("203.0.113.0/24\n"), 0o600), "The file should be writable.")
+		require.NoErrorf(t, os.Rename(replacement, path), "The file should be replaceable.")
+
+		t.Logf("\tTest %d: Whether an atomically replaced file is picked up.", testId)
+		require.Eventuallyf(t, func() bool {
+			return plugin.lookupTrustedSet(net.ParseIP("203.0.113.1")) != nil && plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")) == nil
+		}, 2*time.Second, 10*time.Millisecond, "The list of the replaced file should be used.")
+	}
+}
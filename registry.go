@@ -0,0 +1,372 @@
+package reverseguard
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registry keeps the dynamic sources shared by all the guards of all the middleware instances. Traefik creates
+// a new middleware instance on every dynamic configuration change, and the same url is often referenced by several
+// guards, so an identical source is fetched once: the subscribers get its current list right away and every
+// update is fanned out to them. The syncing routine of the source runs with the shortest interval requested by
+// the subscribers and at the times of their schedules, and it is stopped once its last subscriber is released.
+// The instances are registered by their middleware names, so an instance releases the previous one of the same
+// name even if Traefik never cancels its context.
+var registry = &sourceRegistry{pollers: make(map[string]*poller), instances: make(map[string]*ReverseGuard)}
+
+type sourceRegistry struct {
+	mu        sync.Mutex
+	pollers   map[string]*poller
+	instances map[string]*ReverseGuard
+}
+
+// poller is the syncing routine of a dynamic source.
+type poller struct {
+	registry    *sourceRegistry
+	key         string
+	source      *DynamicCIDR // performs the fetches
+	subscribers map[*subscriber]struct{}
+	cancel      context.CancelFunc
+	done        chan struct{}
+	reschedule  chan struct{}
+}
+
+// subscriber is a dynamic subnet list of a guard of a middleware instance, fed by a poller.
+type subscriber struct {
+	key    string
+	name   string
+	proxy  *ReverseProxy
+	dyn    *DynamicCIDR
+	plugin *ReverseGuard
+}
+
+// sourceStats describes a registered source, listed by the admin endpoint for debugging.
+type sourceStats struct {
+	Url         string   `json:"url"`
+	Subscribers int      `json:"subscribers"`
+	Guards      []string `json:"guards"`
+	Interval    string   `json:"interval,omitempty"`
+	Schedules   []string `json:"schedules,omitempty"`
+	Subnets     int      `json:"subnets"`
+}
+
+// key identifies the source by all the options affecting the fetched list. The scheduling options
+// (interval, interval_jitter and schedule) are not included: they are merged between the subscribers.
+func (d *DynamicCIDR) key() string {
+	return strings.Join([]string{d.listKey(), d.cacheDir, fmt.Sprint(d.cacheMaxAge)}, "\n")
+}
+
+// listKey identifies the source by the options affecting the fetched list, the cache options aside.
+// Two sources of the same url may get different lists, e.g. by their headers or TLS client certificates.
+func (d *DynamicCIDR) listKey() string {
+	var filter []string
+	for k, v := range d.JSONFilter {
+		filter = append(filter, k+"="+v)
+	}
+
+	sort.Strings(filter)
+
+	parts := []string{
+		d.Url,
+		d.Format,
+		strings.Join(d.JSONPaths, ","),
+		strings.Join(filter, ","),
+		fmt.Sprint(d.MaxBytes, d.timeout, d.UserAgent, d.watchInterval),
+		fmt.Sprint(d.OnInvalidEntry, d.minValidRatio),
+		fmt.Sprint(d.OnExpiry, d.maxStaleness),
+	}
+
+	if d.Retry != nil {
+		parts = append(parts, "retry", fmt.Sprint(d.Retry.MaxAttempts, d.Retry.initialBackoff, d.Retry.maxBackoff, d.Retry.Jitter))
+	}
+
+	if s := d.Safeguards; s != nil {
+		parts = append(parts, "safeguards", fmt.Sprint(s.MinEntries, s.MaxEntries, s.MaxChangeRatio, s.MinPrefixV4, s.MinPrefixV6, s.rejectCIDRs))
+	}
+
+	if d.isDnsUrl() {
+		parts = append(parts, "dns", fmt.Sprint(d.DNSResolver, d.DNSMaxDepth))
+	}
+
+	if len(d.Headers) > 0 {
+		var headers []string
+		for k, v := range d.Headers {
+			headers = append(headers, k+"="+v)
+		}
+
+		sort.Strings(headers)
+
+		parts = append(parts, "headers", strings.Join(headers, ","))
+	}
+
+	if d.TLS != nil {
+		parts = append(parts, "tls", d.TLS.key())
+	}
+
+	if v := d.Verify; v != nil {
+		parts = append(parts, "verify", fmt.Sprint(v.PublicKey, v.SignatureUrl, v.SHA256))
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// subscribe binds the dynamic list to the source. If the source is already registered, its current list is reused.
+// Otherwise, the list is loaded and the syncing routine of the source is started.
+// The subscription lasts until the middleware instance is released.
+func (s *sourceRegistry) subscribe(sub *subscriber) error {
+	key := sub.dyn.key()
+	sub.key = key
+
+	if !s.join(key, sub) {
+		if err := sub.plugin.loadDynamicCIDR(sub.name, sub.proxy, sub.dyn); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+
+		if p, ok := s.pollers[key]; ok {
+			// the same source has been registered concurrently
+			p.subscribers[sub] = struct{}{}
+			p.notify()
+		} else {
+			pollerCtx, cancel := context.WithCancel(context.Background())
+			p = &poller{
+				registry:    s,
+				key:         key,
+				source:      sub.dyn,
+				subscribers: map[*subscriber]struct{}{sub: {}},
+				cancel:      cancel,
+				done:        make(chan struct{}),
+				reschedule:  make(chan struct{}, 1),
+			}
+			s.pollers[key] = p
+
+			go p.run(pollerCtx)
+		}
+
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+// replace registers the middleware instance by its name and releases the previous instance of the same name.
+// The new instance has already subscribed, so the sources shared by both of them keep running.
+func (s *sourceRegistry) replace(plugin *ReverseGuard) {
+	s.mu.Lock()
+	previous := s.instances[plugin.name]
+	s.instances[plugin.name] = plugin
+	s.mu.Unlock()
+
+	if previous != nil {
+		previous.successor.Store(plugin)
+		previous.release()
+	}
+}
+
+// forget unregisters the released middleware instance unless it has already been replaced.
+func (s *sourceRegistry) forget(plugin *ReverseGuard) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.instances[plugin.name] == plugin {
+		delete(s.instances, plugin.name)
+	}
+}
+
+// lookup returns the registered source, if any.
+func (s *sourceRegistry) lookup(key string) *poller {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pollers[key]
+}
+
+// join subscribes the dynamic list to the registered source, if any, and copies its current list.
+func (s *sourceRegistry) join(key string, sub *subscriber) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pollers[key]
+	if !ok {
+		return false
+	}
+
+	sub.dyn.setCIDRs(p.source.cidrs())
+	p.subscribers[sub] = struct{}{}
+	p.notify()
+
+	writeOut(fmt.Sprintf(
+		"Reverse proxy %q, endpoint %q is already loaded. Number of subnets: %d. Subscribers: %d",
+		sub.name,
+		sub.dyn.Url,
+		len(sub.dyn.cidrs()),
+		len(p.subscribers),
+	))
+
+	return true
+}
+
+// unsubscribe removes the subscription and stops the routine once it has no subscribers left.
+func (s *sourceRegistry) unsubscribe(key string, sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pollers[key]
+	if !ok {
+		return
+	}
+
+	if _, ok := p.subscribers[sub]; !ok {
+		return
+	}
+
+	delete(p.subscribers, sub)
+
+	writeOut(fmt.Sprintf("Reverse proxy %q has unsubscribed from endpoint %q. Subscribers: %d", sub.name, sub.dyn.Url, len(p.subscribers)))
+
+	if len(p.subscribers) == 0 {
+		delete(s.pollers, key)
+		p.cancel()
+
+		return
+	}
+
+	p.notify()
+}
+
+// stats returns the registered sources ordered by url.
+func (s *sourceRegistry) stats() []sourceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]sourceStats, 0, len(s.pollers))
+
+	for _, p := range s.pollers {
+		item := sourceStats{
+			Url:         p.source.Url,
+			Subscribers: len(p.subscribers),
+			Subnets:     len(p.source.cidrs()),
+		}
+
+		for sub := range p.subscribers {
+			item.Guards = append(item.Guards, sub.name)
+		}
+
+		sort.Strings(item.Guards)
+
+		if interval, _ := p.scheduleLocked(); interval > 0 {
+			item.Interval = interval.String()
+		}
+
+		item.Schedules = p.cronSchedulesLocked()
+
+		stats = append(stats, item)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Url < stats[j].Url
+	})
+
+	return stats
+}
+
+// notify wakes the syncing routine up to recalculate its schedule after the subscribers have changed.
+func (p *poller) notify() {
+	select {
+	case p.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// schedule returns the shortest interval requested by the subscribers along with the largest jitter.
+// Zero interval means that no subscriber needs the list to be synced.
+func (p *poller) schedule() (time.Duration, float64) {
+	p.registry.mu.Lock()
+	defer p.registry.mu.Unlock()
+
+	return p.scheduleLocked()
+}
+
+func (p *poller) scheduleLocked() (time.Duration, float64) {
+	var interval time.Duration
+	var jitter float64
+
+	for sub := range p.subscribers {
+		if sub.dyn.interval == nil {
+			continue
+		}
+
+		if d := sub.dyn.interval.Duration(); interval == 0 || d < interval {
+			interval = d
+		}
+
+		if sub.dyn.IntervalJitter > jitter {
+			jitter = sub.dyn.IntervalJitter
+		}
+	}
+
+	return interval, jitter
+}
+
+// nextScheduled returns the first time after the given one matching any of the cron schedules of the subscribers,
+// along with the schedules. It is zero if no subscriber has a schedule.
+func (p *poller) nextScheduled(after time.Time) (time.Time, []string) {
+	p.registry.mu.Lock()
+	defer p.registry.mu.Unlock()
+
+	var next time.Time
+
+	for sub := range p.subscribers {
+		if sub.dyn.schedule == nil {
+			continue
+		}
+
+		if t := sub.dyn.schedule.next(after); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	return next, p.cronSchedulesLocked()
+}
+
+// cronSchedulesLocked returns the distinct cron schedules of the subscribers, sorted.
+func (p *poller) cronSchedulesLocked() []string {
+	seen := make(map[string]bool)
+
+	var schedules []string
+
+	for sub := range p.subscribers {
+		if sub.dyn.schedule != nil && !seen[sub.dyn.schedule.expr] {
+			seen[sub.dyn.schedule.expr] = true
+			schedules = append(schedules, sub.dyn.schedule.expr)
+		}
+	}
+
+	sort.Strings(schedules)
+
+	return schedules
+}
+
+// publish fans the current list of the source out to the subscribers and rebuilds their indexes.
+func (p *poller) publish() {
+	p.registry.mu.Lock()
+	subscribers := make([]*subscriber, 0, len(p.subscribers))
+	for sub := range p.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	p.registry.mu.Unlock()
+
+	list := p.source.cidrs()
+
+	for _, sub := range subscribers {
+		sub.dyn.setCIDRs(list)
+		sub.plugin.rebuildIndex()
+
+		writeOut(fmt.Sprintf("Reverse proxy %q, total number of subnets: %d", sub.name, sub.proxy.countCIDRs()))
+	}
+}
@@ -0,0 +1,309 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingListServer is a local HTTP server which serves a subnet list and counts the requests.
+type countingListServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	content  string
+	requests int
+}
+
+func newCountingListServer(t testing.TB, content string) *countingListServer {
+	server := &countingListServer{content: content}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		server.requests++
+		_, _ = rw.Write([]byte(server.content))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (s *countingListServer) set(content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.content = content
+}
+
+func (s *countingListServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+func lookupPoller(key string) *poller {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	return registry.pollers[key]
+}
+
+func countSubscribers(key string) int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if p, ok := registry.pollers[key]; ok {
+		return len(p.subscribers)
+	}
+
+	return 0
+}
+
+// waitUnregistered waits for the source to be unregistered after its subscribers are gone.
+func waitUnregistered(t testing.TB, url string) {
+	require.Eventuallyf(t, func() bool {
+		for _, v := range registry.stats() {
+			if v.Url == url {
+				return false
+			}
+		}
+
+		return true
+	}, time.Second, 10*time.Millisecond, "The source %q should be unregistered.", url)
+}
+
+func TestSourceLifecycle(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	server := newCountingListServer(t, "192.0.2.0/24\n")
+
+	newInstance := func(ctx context.Context, name string, interval string, userAgent string) (*ReverseGuard, *DynamicCIDR) {
+		dyn := &DynamicCIDR{Url: server.URL, RawInterval: interval, UserAgent: userAgent}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, name)
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		return handler.(*ReverseGuard), dyn
+	}
+
+	t.Log("Given the need to check that the syncing routines are shared between the middleware instances and stopped with them.")
+	{
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		ctx3, cancel3 := context.WithCancel(context.Background())
+		defer cancel3()
+
+		plugin1, dyn := newInstance(ctx1, "ReverseGuard1", "1s", "")
+		plugin2, _ := newInstance(ctx2, "ReverseGuard2", "1s", "")
+		key := dyn.key()
+		p := lookupPoller(key)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the second instance reuses the routine and the list of the first one.", testId)
+		require.NotNilf(t, p, "The routine should be registered.")
+		require.Equalf(t, 2, countSubscribers(key), "The routine should have two subscribers.")
+		require.Equalf(t, 1, server.count(), "The source should be fetched once.")
+		require.NotNilf(t, plugin2.lookupTrustedSet(net.ParseIP("192.0.2.1")), "The second instance should trust the reused list.")
+
+		testId++
+
+		_, dyn3 := newInstance(ctx3, "ReverseGuard3", "1s", "Other")
+
+		t.Logf("\tTest %d: Whether a source with different settings gets its own routine.", testId)
+		require.NotEqualf(t, key, dyn3.key(), "The keys of the sources should differ.")
+		require.Equalf(t, 1, countSubscribers(dyn3.key()), "The other routine should have one subscriber.")
+
+		testId++
+
+		server.set("198.51.100.0/24\n")
+
+		t.Logf("\tTest %d: Whether the updates are fanned out to all the subscribers.", testId)
+		require.Eventuallyf(t, func() bool {
+			return plugin1.lookupTrustedSet(net.ParseIP("198.51.100.1")) != nil && plugin2.lookupTrustedSet(net.ParseIP("198.51.100.1")) != nil
+		}, 5*time.Second, 50*time.Millisecond, "Both instances should trust the updated list.")
+
+		testId++
+
+		cancel1()
+
+		t.Logf("\tTest %d: Whether the routine keeps running when one of the instances is replaced.", testId)
+		require.Eventuallyf(t, func() bool { return countSubscribers(key) == 1 }, time.Second, 10*time.Millisecond, "The routine should have one subscriber left.")
+		require.Samef(t, p, lookupPoller(key), "The routine should keep running.")
+
+		testId++
+
+		cancel2()
+
+		t.Logf("\tTest %d: Whether the routine is stopped once all the instances are replaced.", testId)
+		require.Eventuallyf(t, func() bool { return lookupPoller(key) == nil }, time.Second, 10*time.Millisecond, "The routine should be unregistered.")
+
+		select {
+		case <-p.done:
+		case <-time.After(time.Second):
+			require.Fail(t, "The routine should exit.")
+		}
+
+		testId++
+
+		requests := server.count()
+		time.Sleep(1500 * time.Millisecond)
+
+		t.Logf("\tTest %d: Whether the stopped routine doesn't poll the source anymore.", testId)
+		require.LessOrEqualf(t, server.count()-requests, 1, "Only the routine with other settings should poll the source.")
+	}
+
+	t.Log("Given the need to check that an instance is released once another one of the same name replaces it.")
+	{
+		// Traefik may never cancel the context
+		ctx := context.Background()
+		server := newCountingListServer(t, "192.0.2.0/24\n")
+
+		newConfig := func(urls ...string) *Config {
+			proxy := &ReverseProxy{RawStaticCIDRs: []string{"203.0.113.0/24"}}
+			for _, url := range urls {
+				proxy.DynamicCIDRs = append(proxy.DynamicCIDRs, &DynamicCIDR{Url: url, RawInterval: "1s"})
+			}
+
+			return &Config{Map: map[string]*ReverseProxy{"partner": proxy}}
+		}
+
+		handler1, err := New(ctx, next, newConfig(server.URL), "Replaced")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		handler2, err := New(ctx, next, newConfig(server.URL), "Replaced")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		key := handler2.(*ReverseGuard).config.Map["partner"].DynamicCIDRs[0].key()
+		p := lookupPoller(key)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the replaced instance is unsubscribed while the routine keeps running.", testId)
+		require.Equalf(t, 1, countSubscribers(key), "The routine should have one subscriber.")
+		require.Samef(t, p, lookupPoller(key), "The routine should keep running.")
+
+		testId++
+
+		server.set("198.51.100.0/24\n")
+
+		require.Eventuallyf(t, func() bool {
+			return handler2.(*ReverseGuard).lookupTrustedSet(net.ParseIP("198.51.100.1")) != nil
+		}, 5*time.Second, 50*time.Millisecond, "The instance should trust the updated list.")
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "198.51.100.1:1234"
+		rw := httptest.NewRecorder()
+		handler1.ServeHTTP(rw, req)
+
+		t.Logf("\tTest %d: Whether the replaced instance serves by the lists of its successor.", testId)
+		require.Equalf(t, http.StatusOK, rw.Code, "The IP of the updated list should be trusted.")
+
+		testId++
+
+		_, err = New(ctx, next, newConfig(server.URL, "not a url"), "Broken")
+
+		t.Logf("\tTest %d: Whether the sources of an invalid configuration are released.", testId)
+		require.ErrorContainsf(t, err, "the url \"not a url\" is invalid", "An error should occur if the configuration is invalid.")
+		require.Equalf(t, 1, countSubscribers(key), "The routine should have one subscriber.")
+
+		testId++
+
+		_, err = New(ctx, next, newConfig(), "Replaced")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		t.Logf("\tTest %d: Whether the routine is stopped once the source is removed from the configuration.", testId)
+		require.Nilf(t, lookupPoller(key), "The routine should be unregistered.")
+
+		select {
+		case <-p.done:
+		case <-time.After(time.Second):
+			require.Fail(t, "The routine should exit.")
+		}
+	}
+}
+
+func TestSharedSources(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	server := newCountingListServer(t, "192.0.2.0/24\n")
+
+	t.Log("Given the need to check that the guards share the identical sources.")
+	{
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		defer cancel2()
+
+		// the expired entries of a deny list are denied, so the allow lists are to deny them as well to share the source
+		dyn := &DynamicCIDR{Url: server.URL, RawInterval: "1h", OnExpiry: ExpiryDeny}
+		items := map[string]*ReverseProxy{
+			"first":  {DynamicCIDRs: []*DynamicCIDR{dyn}},
+			"second": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, OnExpiry: ExpiryDeny}}},
+			"third": {
+				RawStaticCIDRs:   []string{"0.0.0.0/0"},
+				DenyDynamicCIDRs: []*DynamicCIDR{{Url: server.URL, RawInterval: "2h", IntervalJitter: 0.1}},
+			},
+		}
+
+		_, err := New(ctx1, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		key := dyn.key()
+		p := lookupPoller(key)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the source is fetched once for all the guards regardless of the interval.", testId)
+		require.Equalf(t, 1, server.count(), "The source should be fetched once.")
+		require.Equalf(t, 3, countSubscribers(key), "The source should have three subscribers.")
+
+		testId++
+
+		interval, jitter := p.schedule()
+
+		t.Logf("\tTest %d: Whether the source is synced by the shortest interval.", testId)
+		require.Equalf(t, time.Hour, interval, "The shortest interval should be used.")
+		require.Equalf(t, 0.1, jitter, "The largest jitter should be used.")
+
+		testId++
+
+		items = map[string]*ReverseProxy{"fourth": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, RawInterval: "1s", OnExpiry: ExpiryDeny}}}}
+
+		handler, err := New(ctx2, next, &Config{Map: items}, "OtherGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		interval, _ = p.schedule()
+
+		t.Logf("\tTest %d: Whether a shorter interval of another instance is applied.", testId)
+		require.Equalf(t, time.Second, interval, "The shorter interval should be used.")
+		require.Eventuallyf(t, func() bool { return server.count() > 1 }, 5*time.Second, 50*time.Millisecond, "The source should be polled by the shorter interval.")
+
+		testId++
+
+		var stats []sourceStats
+		for _, v := range registry.stats() {
+			if v.Url == server.URL {
+				stats = append(stats, v)
+			}
+		}
+
+		t.Logf("\tTest %d: Whether the reference counts of the source are exposed.", testId)
+		require.Lenf(t, stats, 1, "The source should be registered once.")
+		require.Equalf(t, 4, stats[0].Subscribers, "The source should have four subscribers.")
+		require.Equalf(t, []string{"first", "fourth", "second", "third"}, stats[0].Guards, "The guards of the source should be exposed.")
+		require.Equalf(t, "1s", stats[0].Interval, "The effective interval should be exposed.")
+
+		testId++
+
+		cancel1()
+
+		t.Logf("\tTest %d: Whether the routine is kept for the remaining subscriber.", testId)
+		require.Eventuallyf(t, func() bool { return countSubscribers(key) == 1 }, time.Second, 10*time.Millisecond, "The routine should have one subscriber left.")
+		require.NotNilf(t, handler.(*ReverseGuard).lookupTrustedSet(net.ParseIP("192.0.2.1")), "The remaining instance should trust the shared list.")
+	}
+}
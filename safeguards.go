@@ -0,0 +1,117 @@
+package reverseguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// reservedCIDRs are the special-purpose ranges which are never a legitimate source of proxied requests.
+var reservedCIDRs = []string{
+	"0.0.0.0/8",      // "this" network
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, including the limited broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+}
+
+// init validates the safeguards and parses the rejected ranges.
+func (s *Safeguards) init() error {
+	if s.MinEntries < 0 || s.MaxEntries < 0 {
+		return errors.New("the \"safeguards.min_entries\" and \"safeguards.max_entries\" options must not be negative")
+	}
+
+	if s.MaxEntries > 0 && s.MaxEntries < s.MinEntries {
+		return errors.New("the \"safeguards.max_entries\" option must not be less than \"safeguards.min_entries\"")
+	}
+
+	if s.MaxChangeRatio < 0 {
+		return errors.New("the \"safeguards.max_change_ratio\" option must not be negative")
+	}
+
+	if s.MinPrefixV4 < 0 || s.MinPrefixV4 > 32 {
+		return errors.New("the \"safeguards.min_prefix_v4\" option must be between 0 and 32")
+	}
+
+	if s.MinPrefixV6 < 0 || s.MinPrefixV6 > 128 {
+		return errors.New("the \"safeguards.min_prefix_v6\" option must be between 0 and 128")
+	}
+
+	s.rejectCIDRs = nil
+
+	if s.RejectReserved {
+		for _, v := range reservedCIDRs {
+			_, cidr, _ := net.ParseCIDR(v)
+			s.rejectCIDRs = append(s.rejectCIDRs, cidr)
+		}
+	}
+
+	for _, v := range s.RawRejectCIDRs {
+		cidr, err := parseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("the rejected range %q is invalid", v)
+		}
+
+		s.rejectCIDRs = append(s.rejectCIDRs, cidr)
+	}
+
+	return nil
+}
+
+// check validates the new list of the source against the safeguards. The previous list is used to limit the change.
+func (s *Safeguards) check(list []cidrEntry, previous []cidrEntry) error {
+	if s.MinEntries > 0 && len(list) < s.MinEntries {
+		return fmt.Errorf("the list has %d entries, which is fewer than the min_entries of %d", len(list), s.MinEntries)
+	}
+
+	if s.MaxEntries > 0 && len(list) > s.MaxEntries {
+		return fmt.Errorf("the list has %d entries, which is more than the max_entries of %d", len(list), s.MaxEntries)
+	}
+
+	for _, v := range list {
+		cidr := mappedToIPv4(v.cidr)
+		ones, bits := cidr.Mask.Size()
+
+		if bits == 8*net.IPv4len && ones < s.MinPrefixV4 || bits == 8*net.IPv6len && ones < s.MinPrefixV6 {
+			return fmt.Errorf("the subnet %s from %q is broader than allowed by the min_prefix_v4/min_prefix_v6 options", v.cidr, v.origin)
+		}
+
+		for _, rejected := range s.rejectCIDRs {
+			if rejected.Contains(cidr.IP) || cidr.Contains(rejected.IP) {
+				return fmt.Errorf("the subnet %s from %q overlaps the rejected range %s", v.cidr, v.origin, rejected)
+			}
+		}
+	}
+
+	if s.MaxChangeRatio > 0 && len(previous) > 0 {
+		added, removed := diffCIDRs(previous, list)
+
+		if ratio := float64(added+removed) / float64(len(previous)); ratio > s.MaxChangeRatio {
+			return fmt.Errorf(
+				"the list changes by %d added and %d removed subnets out of %d, which exceeds the max_change_ratio of %g",
+				added,
+				removed,
+				len(previous),
+				s.MaxChangeRatio,
+			)
+		}
+	}
+
+	return nil
+}
+
+// mappedToIPv4 converts the IPv4-mapped IPv6 subnet (e.g. ::ffff:192.0.2.0/120) to the IPv4 one it is matched as,
+// by the same rule as the index uses.
+func mappedToIPv4(cidr *net.IPNet) *net.IPNet {
+	ones, bits := cidr.Mask.Size()
+
+	if ip4 := cidr.IP.To4(); bits == 8*net.IPv6len && ip4 != nil && ones >= 96 {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+	}
+
+	return cidr
+}
@@ -0,0 +1,125 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSafeguards(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the safeguards of dynamic_cidrs sections.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		tests := []struct {
+			safeguards *Safeguards
+			expected   string
+		}{
+			{&Safeguards{MinEntries: -1}, "must not be negative"},
+			{&Safeguards{MinEntries: 10, MaxEntries: 5}, "\"safeguards.max_entries\" option must not be less than"},
+			{&Safeguards{MaxChangeRatio: -0.5}, "\"safeguards.max_change_ratio\" option must not be negative"},
+			{&Safeguards{MinPrefixV4: 33}, "\"safeguards.min_prefix_v4\" option must be between 0 and 32"},
+			{&Safeguards{MinPrefixV6: 129}, "\"safeguards.min_prefix_v6\" option must be between 0 and 128"},
+			{&Safeguards{RawRejectCIDRs: []string{"10.0.0.0/33"}}, "the rejected range \"10.0.0.0/33\" is invalid"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, Safeguards: test.safeguards}}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the validation of the lists against the safeguards.")
+	{
+		entries := func(cidrs ...string) []cidrEntry {
+			var list []cidrEntry
+			for _, v := range cidrs {
+				list = append(list, cidrEntry{cidr: mustParseCIDR(t, v), origin: "test"})
+			}
+
+			return list
+		}
+
+		previous := entries("192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "100.64.0.0/10")
+
+		tests := []struct {
+			name       string
+			safeguards *Safeguards
+			list       []cidrEntry
+			expected   string
+		}{
+			{"enough entries", &Safeguards{MinEntries: 2}, entries("192.0.2.0/24", "198.51.100.0/24"), ""},
+			{"truncated list", &Safeguards{MinEntries: 2}, entries("192.0.2.0/24"), "fewer than the min_entries of 2"},
+			{"empty list", &Safeguards{MinEntries: 1}, nil, "fewer than the min_entries of 1"},
+			{"oversized list", &Safeguards{MaxEntries: 1}, entries("192.0.2.0/24", "198.51.100.0/24"), "more than the max_entries of 1"},
+			{"narrow subnets", &Safeguards{MinPrefixV4: 8, MinPrefixV6: 32}, entries("10.0.0.0/8", "2001:db8::/32"), ""},
+			{"broad IPv4 subnet", &Safeguards{MinPrefixV4: 8}, entries("0.0.0.0/0"), "0.0.0.0/0 from \"test\" is broader"},
+			{"broad IPv6 subnet", &Safeguards{MinPrefixV6: 32}, entries("2000::/3"), "2000::/3 from \"test\" is broader"},
+			{"broad IPv4-mapped subnet", &Safeguards{MinPrefixV4: 8}, entries("::ffff:0.0.0.0/96"), "the subnet 0.0.0.0/0 from \"test\" is broader"},
+			{"narrow IPv4-mapped subnet", &Safeguards{MinPrefixV4: 24, MinPrefixV6: 128}, entries("::ffff:192.0.2.0/120"), ""},
+			{"reserved range", &Safeguards{RejectReserved: true}, entries("127.0.0.1/32"), "overlaps the rejected range 127.0.0.0/8"},
+			{"range covering a reserved one", &Safeguards{RejectReserved: true}, entries("0.0.0.0/0"), "overlaps the rejected range"},
+			{"IPv4-mapped reserved range", &Safeguards{RejectReserved: true}, entries("::ffff:127.0.0.1/128"), "overlaps the rejected range 127.0.0.0/8"},
+			{"IPv6 reserved range", &Safeguards{RejectReserved: true}, entries("fe80::1/128"), "overlaps the rejected range fe80::/10"},
+			{"public ranges", &Safeguards{RejectReserved: true}, entries("192.0.2.0/24", "2001:db8::/32"), ""},
+			{"custom rejected range", &Safeguards{RawRejectCIDRs: []string{"10.0.0.0/8"}}, entries("10.1.0.0/16"), "overlaps the rejected range 10.0.0.0/8"},
+			{"small change", &Safeguards{MaxChangeRatio: 0.5}, entries("192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "172.16.0.0/12"), ""},
+			{"large change", &Safeguards{MaxChangeRatio: 0.5}, entries("192.0.2.0/24", "172.16.0.0/12"), "1 added and 3 removed subnets out of 4"},
+		}
+
+		for testId, test := range tests {
+			require.NoErrorf(t, test.safeguards.init(), "The safeguards should be valid.")
+
+			err := test.safeguards.check(test.list, previous)
+
+			if test.expected == "" {
+				t.Logf("\tTest %d: Whether the %s case passes.", testId, test.name)
+				require.NoErrorf(t, err, "The %s case should pass the safeguards.", test.name)
+				continue
+			}
+
+			t.Logf("\tTest %d: Whether the %s case is rejected with the error %q.", testId, test.name, test.expected)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check that a refresh violating the safeguards keeps the previous list.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n198.51.100.0/24\n")
+		dyn := &DynamicCIDR{Url: server.URL, Safeguards: &Safeguards{MinEntries: 2, MinPrefixV4: 8}}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		tests := []struct {
+			content  string
+			expected string
+		}{
+			{"", "fewer than the min_entries of 2"},
+			{"192.0.2.0/24\n0.0.0.0/0\n", "is broader"},
+		}
+
+		for testId, test := range tests {
+			server.set(test.content)
+
+			_, err := dyn.update()
+
+			t.Logf("\tTest %d: Whether the list %q is rejected and the previous one is kept.", testId, test.content)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+			require.Lenf(t, dyn.cidrs(), 2, "The previous list should be kept.")
+			require.Nilf(t, plugin.lookupTrustedSet(net.ParseIP("203.0.113.1")), "The IP outside the previous list should not be trusted.")
+		}
+	}
+}
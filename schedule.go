@@ -0,0 +1,201 @@
+package reverseguard
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression of the standard five fields: minute, hour, day of month, month
+// and day of week. The times are evaluated in UTC, since the providers publish their lists by UTC.
+type cronSchedule struct {
+	expr    string
+	minutes uint64
+	hours   uint64
+	days    uint64
+	months  uint64
+	weekday uint64
+	// if both the day of month and the day of week are restricted, either of them matches, as in cron
+	anyDay     bool
+	anyWeekday bool
+}
+
+// cronField is the range of a field of the cron expression along with the names of its values.
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseSchedule parses the cron expression, e.g. "15 */6 * * *" or "@daily". Every field may hold
+// a value, a range (1-5), a step (*/15 or 1-30/5), a list of them (1,15) or *. The months and the days
+// of week may be given by their names (jan, mon). Both 0 and 7 stand for Sunday.
+func parseSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if descriptor, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		fields = strings.Fields(descriptor)
+	}
+
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("the schedule %q is invalid: 5 fields expected (minute, hour, day of month, month, day of week)", expr)
+	}
+
+	schedule := &cronSchedule{expr: expr}
+	sets := []*uint64{&schedule.minutes, &schedule.hours, &schedule.days, &schedule.months, &schedule.weekday}
+
+	for i, field := range fields {
+		set, err := cronFields[i].parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("the schedule %q is invalid: %s", expr, err.Error())
+		}
+
+		*sets[i] = set
+	}
+
+	// Sunday is both 0 and 7
+	if schedule.weekday&(1<<7) != 0 {
+		schedule.weekday |= 1
+	}
+
+	schedule.anyDay = strings.HasPrefix(fields[2], "*")
+	schedule.anyWeekday = strings.HasPrefix(fields[4], "*")
+
+	if schedule.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("the schedule %q never fires", expr)
+	}
+
+	return schedule, nil
+}
+
+// parse returns the bit set of the values of the field.
+func (f *cronField) parse(field string) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q of the %s", stepPart, f.name)
+			}
+		}
+
+		from, to := f.min, f.max
+
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+
+			from, err = f.value(first)
+			if err != nil {
+				return 0, err
+			}
+
+			to = from
+
+			if isRange {
+				to, err = f.value(last)
+				if err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = f.max
+			}
+
+			if from > to {
+				return 0, fmt.Errorf("the %s range %q is reversed", f.name, rangePart)
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// value parses a single value of the field, a number or a name.
+func (f *cronField) value(value string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(value, name) {
+			return f.min + i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q, %d-%d expected", f.name, value, f.min, f.max)
+	}
+
+	return v, nil
+}
+
+// next returns the first time matching the schedule after the given one, or zero if there is none
+// within the next five years.
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekday&(1<<uint(t.Weekday())) != 0
+
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+
+	return day || weekday
+}
@@ -0,0 +1,185 @@
+package reverseguard
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInterval(t *testing.T) {
+	t.Log("Given the need to check the parsing of intervals.")
+	{
+		tests := []struct {
+			value    string
+			expected time.Duration
+		}{
+			{"60s", time.Minute},
+			{"5m", 5 * time.Minute},
+			{"1h30m", 90 * time.Minute},
+			{"1.5h", 90 * time.Minute},
+			{"2d", 48 * time.Hour},
+			{"1w", 7 * 24 * time.Hour},
+			{"1d12h", 36 * time.Hour},
+		}
+
+		for testId, test := range tests {
+			interval, err := ParseInterval(test.value)
+
+			t.Logf("\tTest %d: Whether the interval %q is %s.", testId, test.value, test.expected)
+			require.NoErrorf(t, err, "An error should not occur if the interval is valid.")
+			require.Equalf(t, test.expected, interval.Duration(), "The interval should be parsed correctly.")
+		}
+	}
+
+	t.Log("Given the need to check probably errors in intervals.")
+	{
+		tests := []struct {
+			value    string
+			expected string
+		}{
+			{"1M", "the unit \"M\" is unknown"},
+			{"", "is invalid"},
+			{"h", "is invalid"},
+			{"5m!", "is invalid"},
+			{"1h 30m", "is unknown"},
+			{"500ms", "must be between 1s and"},
+			{"0s", "must be between 1s and"},
+			{"999999w", "must be between 1s and"},
+		}
+
+		for testId, test := range tests {
+			_, err := ParseInterval(test.value)
+
+			t.Logf("\tTest %d: Whether the interval %q is rejected.", testId, test.value)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the intervals of the number of the units.")
+	{
+		tests := []struct {
+			number   int
+			unit     string
+			expected time.Duration
+			err      string
+		}{
+			{5, "m", 5 * time.Minute, ""},
+			{2, "d", 48 * time.Hour, ""},
+			{0, "s", 0, "the number must be greater than zero"},
+			{500, "ms", 0, "must be between 1s and"},
+			{999, "ns", 0, "must be between 1s and"},
+			{1, "M", 0, "the unit \"M\" is unknown"},
+		}
+
+		for testId, test := range tests {
+			interval, err := NewInterval(test.number, test.unit)
+
+			if test.err != "" {
+				t.Logf("\tTest %d: Whether the interval of %d%s is rejected.", testId, test.number, test.unit)
+				require.ErrorContainsf(t, err, test.err, "An error message should contain %q.", test.err)
+
+				continue
+			}
+
+			t.Logf("\tTest %d: Whether the interval of %d%s is %s.", testId, test.number, test.unit, test.expected)
+			require.NoErrorf(t, err, "An error should not occur if the interval is valid.")
+			require.Equalf(t, test.expected, interval.Duration(), "The interval should be correct.")
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	t.Log("Given the need to check probably errors in the schedule option.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		tests := []struct {
+			dynamicCIDR *DynamicCIDR
+			expected    string
+		}{
+			{&DynamicCIDR{Url: server.URL, RawInterval: "1h", Schedule: "@hourly"}, "the \"interval\" and \"schedule\" options are mutually exclusive"},
+			{&DynamicCIDR{Url: server.URL, Schedule: "* * * *"}, "5 fields expected"},
+			{&DynamicCIDR{Url: server.URL, Schedule: "60 * * * *"}, "invalid minute \"60\", 0-59 expected"},
+			{&DynamicCIDR{Url: server.URL, Schedule: "0 */0 * * *"}, "invalid step \"0\" of the hour"},
+			{&DynamicCIDR{Url: server.URL, Schedule: "0 0 * * fri-mon"}, "the day of week range \"fri-mon\" is reversed"},
+			{&DynamicCIDR{Url: server.URL, Schedule: "0 0 30 feb *"}, "never fires"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{test.dynamicCIDR}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, "partner", "An error message should contain a name of configuration in which an error occurred.")
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the times of the schedules.")
+	{
+		// Friday
+		after := time.Date(2026, time.October, 16, 10, 20, 30, 0, time.UTC)
+
+		tests := []struct {
+			expr     string
+			expected time.Time
+		}{
+			{"*/15 * * * *", time.Date(2026, time.October, 16, 10, 30, 0, 0, time.UTC)},
+			{"5 4 * * *", time.Date(2026, time.October, 17, 4, 5, 0, 0, time.UTC)},
+			{"@hourly", time.Date(2026, time.October, 16, 11, 0, 0, 0, time.UTC)},
+			{"0 0 * * MON-fri", time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)},
+			{"0 12 * * 7", time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)},
+			{"0 0 1,15 * *", time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)},
+			{"0 0 13 * 5", time.Date(2026, time.October, 23, 0, 0, 0, 0, time.UTC)},
+			{"30 2 29 feb *", time.Date(2028, time.February, 29, 2, 30, 0, 0, time.UTC)},
+		}
+
+		for testId, test := range tests {
+			schedule, err := parseSchedule(test.expr)
+			require.NoErrorf(t, err, "An error should not occur if the schedule is valid.")
+
+			t.Logf("\tTest %d: Whether the schedule %q fires next at %s.", testId, test.expr, test.expected)
+			require.Equalf(t, test.expected, schedule.next(after), "The next time of the schedule should be correct.")
+		}
+	}
+
+	t.Log("Given the need to check the schedules of a shared source.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		items := map[string]*ReverseProxy{
+			"daily":  {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, Schedule: "0 3 * * *"}}},
+			"hourly": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, Schedule: "@hourly"}}},
+		}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		var p *poller
+
+		registry.mu.Lock()
+		for _, v := range registry.pollers {
+			if v.source.Url == server.URL {
+				p = v
+			}
+		}
+		registry.mu.Unlock()
+
+		after := time.Date(2026, time.October, 16, 2, 20, 0, 0, time.UTC)
+		at, schedules := p.nextScheduled(after)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the source is synced by the earliest of the schedules.", testId)
+		require.Equalf(t, time.Date(2026, time.October, 16, 3, 0, 0, 0, time.UTC), at, "The earliest scheduled time should be used.")
+		require.Equalf(t, []string{"0 3 * * *", "@hourly"}, schedules, "All the schedules should be reported.")
+	}
+}
@@ -0,0 +1,175 @@
+package reverseguard
+
+import (
+	"net"
+)
+
+// cidrTrie is a binary prefix trie (one bit per level) which maps IP subnets to the guards trusting or denying them.
+// IPv4 and IPv6 subnets are kept in separate roots, so a lookup costs at most 32 or 128 steps
+// regardless of the number of the stored subnets.
+type cidrTrie struct {
+	v4       *trieNode
+	v6       *trieNode
+	strategy string
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	marks    []trieMark
+}
+
+// trieMark binds a subnet to a guard. Within a guard, the mark of the most specific subnet wins.
+type trieMark struct {
+	proxy *ReverseProxy
+	deny  bool
+}
+
+// trieVerdict is the mark of the most specific subnet of a guard found so far during a lookup.
+type trieVerdict struct {
+	trieMark
+	ones int
+}
+
+func newCIDRTrie(strategy string) *cidrTrie {
+	return &cidrTrie{
+		v4:       &trieNode{},
+		v6:       &trieNode{},
+		strategy: strategy,
+	}
+}
+
+// insert binds the subnet to the guard as a trusted one.
+func (t *cidrTrie) insert(cidr *net.IPNet, proxy *ReverseProxy) {
+	t.mark(cidr, trieMark{proxy: proxy})
+}
+
+// insertDeny binds the subnet to the guard as a denied one. If the same subnet is both trusted and denied
+// by the guard, it is denied.
+func (t *cidrTrie) insertDeny(cidr *net.IPNet, proxy *ReverseProxy) {
+	t.mark(cidr, trieMark{proxy: proxy, deny: true})
+}
+
+func (t *cidrTrie) mark(cidr *net.IPNet, mark trieMark) {
+	root, key, ones := t.route(cidr.IP, cidr.Mask)
+	if root == nil {
+		return
+	}
+
+	node := root
+
+	for i := 0; i < ones; i++ {
+		bit := key[i/8] >> (7 - uint(i%8)) & 1
+
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+
+		node = node.children[bit]
+	}
+
+	for i, v := range node.marks {
+		if v.proxy == mark.proxy {
+			node.marks[i].deny = v.deny || mark.deny
+			return
+		}
+	}
+
+	node.marks = append(node.marks, mark)
+}
+
+// lookup returns the guard trusting the IP, or nil. A guard trusts the IP if the most specific of its subnets
+// containing the IP is not denied. If several guards trust the IP, the one is chosen according to the match strategy.
+func (t *cidrTrie) lookup(ip net.IP) *ReverseProxy {
+	var root *trieNode
+	var key net.IP
+
+	if ip4 := ip.To4(); ip4 != nil {
+		root, key = t.v4, ip4
+	} else if ip16 := ip.To16(); ip16 != nil {
+		root, key = t.v6, ip16
+	} else {
+		return nil
+	}
+
+	var buf [8]trieVerdict
+	verdicts := buf[:0]
+
+	node := root
+	bits := len(key) * 8
+
+	for i := 0; node != nil; i++ {
+	marks:
+		for _, mark := range node.marks {
+			for j := range verdicts {
+				if verdicts[j].proxy == mark.proxy {
+					verdicts[j] = trieVerdict{trieMark: mark, ones: i}
+					continue marks
+				}
+			}
+
+			verdicts = append(verdicts, trieVerdict{trieMark: mark, ones: i})
+		}
+
+		if i == bits {
+			break
+		}
+
+		node = node.children[key[i/8]>>(7-uint(i%8))&1]
+	}
+
+	var found *trieVerdict
+
+	for i := range verdicts {
+		if verdicts[i].deny {
+			continue
+		}
+
+		if found == nil || t.precedes(&verdicts[i], found) {
+			found = &verdicts[i]
+		}
+	}
+
+	if found == nil {
+		return nil
+	}
+
+	return found.proxy
+}
+
+// precedes reports whether the guard of the verdict a takes precedence over the guard of the verdict b.
+// The guards are ordered by priority (higher first) and then by the prefix length of the matched subnet
+// (longer first), or vice versa for the longest_prefix strategy. The name of the guard breaks the remaining ties.
+func (t *cidrTrie) precedes(a, b *trieVerdict) bool {
+	if t.strategy == MatchLongestPrefix && a.ones != b.ones {
+		return a.ones > b.ones
+	}
+
+	if a.proxy.Priority != b.proxy.Priority {
+		return a.proxy.Priority > b.proxy.Priority
+	}
+
+	if a.ones != b.ones {
+		return a.ones > b.ones
+	}
+
+	return a.proxy.name < b.proxy.name
+}
+
+// route picks the root and the key bytes for the subnet. IPv4-mapped IPv6 subnets (::ffff:a.b.c.d/n, n >= 96)
+// are stored as IPv4 ones.
+func (t *cidrTrie) route(ip net.IP, mask net.IPMask) (*trieNode, net.IP, int) {
+	ones, bits := mask.Size()
+
+	switch {
+	case bits == 8*net.IPv4len && len(ip) >= net.IPv4len:
+		return t.v4, ip.To4(), ones
+	case bits == 8*net.IPv6len:
+		if ip4 := ip.To4(); ip4 != nil && ones >= 96 {
+			return t.v4, ip4, ones - 96
+		}
+
+		return t.v6, ip.To16(), ones
+	}
+
+	return nil, nil, 0
+}
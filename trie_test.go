@@ -0,0 +1,206 @@
+package reverseguard
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func mustParseCIDR(t testing.TB, s string) *net.IPNet {
+	_, cidr, err := net.ParseCIDR(s)
+	require.NoErrorf(t, err, "The subnet %q should be valid.", s)
+
+	return cidr
+}
+
+func TestCIDRTrie(t *testing.T) {
+	t.Log("Given the need to check the lookup of the most specific subnet.")
+	{
+		wide := &ReverseProxy{}
+		narrow := &ReverseProxy{}
+		ipv6 := &ReverseProxy{}
+
+		index := newCIDRTrie(MatchPriority)
+		index.insert(mustParseCIDR(t, "10.0.0.0/8"), wide)
+		index.insert(mustParseCIDR(t, "10.13.0.0/16"), narrow)
+		index.insert(mustParseCIDR(t, "2001:db8::/32"), ipv6)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an IP from the wide subnet only is bound to the wide subnet guard.", testId)
+		require.Samef(t, wide, index.lookup(net.ParseIP("10.1.2.3")), "The IP should be bound to the guard of the 10.0.0.0/8 subnet.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether an IP from the nested subnet is bound to the most specific subnet guard.", testId)
+		require.Samef(t, narrow, index.lookup(net.ParseIP("10.13.2.3")), "The IP should be bound to the guard of the 10.13.0.0/16 subnet.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether an IP outside all the subnets is not bound to any guard.", testId)
+		require.Nilf(t, index.lookup(net.ParseIP("11.0.0.1")), "The IP should not be bound to any guard.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether IPv6 addresses are looked up in the IPv6 subnets.", testId)
+		require.Samef(t, ipv6, index.lookup(net.ParseIP("2001:db8::1")), "The IP should be bound to the guard of the 2001:db8::/32 subnet.")
+		require.Nilf(t, index.lookup(net.ParseIP("2001:db9::1")), "The IP should not be bound to any guard.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether the 0.0.0.0/0 subnet covers any IPv4 address, but no IPv6 one.", testId)
+		index.insert(mustParseCIDR(t, "0.0.0.0/0"), wide)
+		require.Samef(t, wide, index.lookup(net.ParseIP("192.0.2.1")), "The IP should be bound to the guard of the 0.0.0.0/0 subnet.")
+		require.Nilf(t, index.lookup(net.ParseIP("2001:db9::1")), "The IPv6 address should not be bound to an IPv4 subnet.")
+	}
+
+	t.Log("Given the need to check that the most specific subnet wins between the trusted and the denied subnets of a guard.")
+	{
+		proxy := &ReverseProxy{}
+		other := &ReverseProxy{}
+
+		index := newCIDRTrie(MatchPriority)
+		index.insert(mustParseCIDR(t, "10.0.0.0/8"), proxy)
+		index.insertDeny(mustParseCIDR(t, "10.13.0.0/16"), proxy)
+		index.insert(mustParseCIDR(t, "10.13.7.0/24"), proxy)
+		index.insert(mustParseCIDR(t, "192.0.2.0/24"), proxy)
+		index.insertDeny(mustParseCIDR(t, "192.0.2.0/24"), proxy)
+		index.insert(mustParseCIDR(t, "10.13.0.0/16"), other)
+		index.insertDeny(mustParseCIDR(t, "2001:db8::/32"), proxy)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an IP from the trusted subnet only is trusted.", testId)
+		require.Samef(t, proxy, index.lookup(net.ParseIP("10.1.2.3")), "The IP should be trusted by the guard.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether an IP from the denied subnet nested in the trusted one is not trusted by the guard.", testId)
+		require.Samef(t, other, index.lookup(net.ParseIP("10.13.2.3")), "The IP should be trusted by the other guard only.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether an IP from the trusted subnet nested in the denied one is trusted.", testId)
+		require.Samef(t, proxy, index.lookup(net.ParseIP("10.13.7.1")), "The IP should be trusted by the guard with the more specific subnet.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether the denial wins if the same subnet is both trusted and denied.", testId)
+		require.Nilf(t, index.lookup(net.ParseIP("192.0.2.1")), "The IP should not be trusted.")
+
+		testId++
+
+		t.Logf("\tTest %d: Whether a denied subnet alone does not make an IP trusted.", testId)
+		require.Nilf(t, index.lookup(net.ParseIP("2001:db8::1")), "The IP should not be trusted.")
+	}
+
+	t.Log("Given the need to check the precedence of the guards trusting the same IP.")
+	{
+		tests := []struct {
+			strategy string
+			priority [2]int
+			expected string
+		}{
+			{MatchPriority, [2]int{0, 0}, "narrow"},
+			{MatchPriority, [2]int{1, 0}, "wide"},
+			{MatchPriority, [2]int{0, 1}, "narrow"},
+			{MatchLongestPrefix, [2]int{1, 0}, "narrow"},
+			{MatchLongestPrefix, [2]int{0, 0}, "narrow"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{
+				"wide":   {name: "wide", Priority: test.priority[0], staticCIDRS: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}},
+				"narrow": {name: "narrow", Priority: test.priority[1], staticCIDRS: []*net.IPNet{mustParseCIDR(t, "10.13.0.0/16")}},
+			}
+			plugin := &ReverseGuard{config: &Config{Map: items, MatchStrategy: test.strategy}}
+
+			t.Logf("\tTest %d: Whether the %q guard is chosen with the %q strategy and priorities %v.", testId, test.expected, test.strategy, test.priority)
+
+			// the map iteration order is random, so the index is built several times
+			for i := 0; i < 20; i++ {
+				plugin.rebuildIndex()
+				require.Samef(t, items[test.expected], plugin.lookupTrustedSet(net.ParseIP("10.13.0.1")), "The %q guard should be chosen.", test.expected)
+			}
+		}
+
+		items := map[string]*ReverseProxy{
+			"b": {name: "b", staticCIDRS: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}},
+			"a": {name: "a", staticCIDRS: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}},
+			"c": {name: "c", staticCIDRS: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}},
+		}
+		plugin := &ReverseGuard{config: &Config{Map: items, MatchStrategy: MatchPriority}}
+
+		t.Logf("\tTest %d: Whether the guard with the lowest name is chosen if the guards are equal.", len(tests))
+
+		for i := 0; i < 20; i++ {
+			plugin.rebuildIndex()
+			require.Samef(t, items["a"], plugin.lookupTrustedSet(net.ParseIP("10.13.0.1")), "The \"a\" guard should be chosen.")
+		}
+	}
+
+	t.Log("Given the need to check that the index is rebuilt when a dynamic subnet list is updated.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		items := make(map[string]*ReverseProxy, 1)
+		items["partner"] = &ReverseProxy{
+			DynamicCIDRs: []*DynamicCIDR{
+				{Url: server.URL},
+			},
+		}
+
+		handler, err := New(context.Background(), http.NotFoundHandler(), &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the configuration is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether an IP from the initially loaded list is trusted.", testId)
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.10")), "The IP should be trusted.")
+
+		testId++
+
+		server.set("198.51.100.0/24\n")
+		_, err = items["partner"].DynamicCIDRs[0].update()
+		require.NoErrorf(t, err, "An error should not occur while updating the list.")
+		plugin.rebuildIndex()
+
+		t.Logf("\tTest %d: Whether the index reflects the updated list.", testId)
+		require.Nilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.10")), "The IP removed from the list should not be trusted anymore.")
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("198.51.100.10")), "The IP added to the list should be trusted.")
+	}
+}
+
+func BenchmarkLookupTrustedSet(b *testing.B) {
+	for _, size := range []int{10, 1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("prefixes=%d", size), func(b *testing.B) {
+			random := rand.New(rand.NewSource(int64(size)))
+			proxy := &ReverseProxy{}
+
+			for i := 0; i < size; i++ {
+				ip := net.IPv4(byte(random.Intn(224)), byte(random.Intn(256)), byte(random.Intn(256)), 0)
+				proxy.staticCIDRS = append(proxy.staticCIDRS, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(24, 32)})
+			}
+
+			plugin := &ReverseGuard{config: &Config{Map: map[string]*ReverseProxy{"bench": proxy}}}
+			plugin.rebuildIndex()
+
+			ips := make([]net.IP, 1024)
+			for i := range ips {
+				ips[i] = net.IPv4(byte(random.Intn(224)), byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256))).To4()
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				plugin.lookupTrustedSet(ips[i%len(ips)])
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package reverseguard
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	signatureSuffix   = ".sig"
+	maxSignatureBytes = 4 << 10
+)
+
+// init validates the verification options and decodes the key and the digest.
+func (v *Verify) init() error {
+	if v.PublicKey == "" && v.SHA256 == "" {
+		return errors.New("the \"verify\" section requires the \"public_key\" or the \"sha256\" option")
+	}
+
+	if v.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v.PublicKey))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("the \"verify.public_key\" option must be a base64-encoded Ed25519 public key")
+		}
+
+		v.publicKey = key
+	}
+
+	if v.SHA256 != "" {
+		digest, err := hex.DecodeString(strings.TrimSpace(v.SHA256))
+		if err != nil || len(digest) != sha256.Size {
+			return errors.New("the \"verify.sha256\" option must be a hex-encoded SHA-256 digest")
+		}
+
+		v.digest = digest
+	}
+
+	return nil
+}
+
+// verifyDocuments checks every document of the changed list against the pinned digest and the detached signature.
+// A pinned digest describes exactly one document, so it can't be used with directory and glob sources.
+func (d *DynamicCIDR) verifyDocuments(documents []sourceDocument) error {
+	if d.Verify.digest != nil && len(documents) != 1 {
+		return fmt.Errorf("the pinned SHA-256 digest requires a single document, but the source consists of %d", len(documents))
+	}
+
+	for _, document := range documents {
+		if d.Verify.digest != nil {
+			if sum := sha256.Sum256(document.content); !bytes.Equal(sum[:], d.Verify.digest) {
+				return fmt.Errorf("the SHA-256 digest of %q doesn't match the pinned one", document.origin)
+			}
+		}
+
+		if d.Verify.publicKey == nil {
+			continue
+		}
+
+		signature, err := d.readSignature(document)
+		if err != nil {
+			return err
+		}
+
+		if !ed25519.Verify(d.Verify.publicKey, document.content, signature) {
+			return fmt.Errorf("the signature of %q is invalid", document.origin)
+		}
+	}
+
+	return nil
+}
+
+// readSignature loads the detached signature of the document. The signature is accepted both raw
+// and base64-encoded.
+func (d *DynamicCIDR) readSignature(document sourceDocument) ([]byte, error) {
+	var location string
+	var raw []byte
+	var err error
+
+	if d.isFileUrl() {
+		location = document.origin + signatureSuffix
+		raw, err = os.ReadFile(location)
+	} else {
+		location = d.Verify.SignatureUrl
+		if location == "" {
+			location = signatureURL(d.Url)
+		}
+
+		raw, err = d.fetchSignature(location)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the signature %q: %s", location, err.Error())
+	}
+
+	if len(raw) == ed25519.SignatureSize {
+		return raw, nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("the signature %q is malformed", location)
+	}
+
+	return signature, nil
+}
+
+// signatureURL returns the default location of the signature of the remote list: the path of the list with
+// the .sig suffix, e.g. https://h/list.txt.sig?v=1 for https://h/list.txt?v=1.
+func signatureURL(listURL string) string {
+	u, err := url.Parse(listURL)
+	if err != nil {
+		return listURL + signatureSuffix
+	}
+
+	u.Path += signatureSuffix
+	if u.RawPath != "" {
+		u.RawPath += signatureSuffix
+	}
+
+	return u.String()
+}
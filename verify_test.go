@@ -0,0 +1,270 @@
+package reverseguard
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// signedListServer is a local HTTP server which serves a subnet list at /list and its signature at /list.sig.
+// It keeps the Authorization header of the last signature request.
+type signedListServer struct {
+	*httptest.Server
+	mu            sync.Mutex
+	content       string
+	signature     string
+	authorization string
+}
+
+func newSignedListServer(t testing.TB) *signedListServer {
+	server := &signedListServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		switch req.URL.Path {
+		case "/list":
+			_, _ = rw.Write([]byte(server.content))
+		case "/list.sig":
+			server.authorization = req.Header.Get("Authorization")
+
+			if server.signature == "" {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			_, _ = rw.Write([]byte(server.signature))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (s *signedListServer) set(content, signature string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.content = content
+	s.signature = signature
+}
+
+func TestVerification(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoErrorf(t, err, "The key pair should be generated.")
+
+	encodedKey := base64.StdEncoding.EncodeToString(publicKey)
+	sign := func(content string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(content)))
+	}
+
+	t.Log("Given the need to check probably errors in the verify options of dynamic_cidrs sections.")
+	{
+		server := newListServer(t, "192.0.2.0/24\n")
+
+		tests := []struct {
+			verify   *Verify
+			expected string
+		}{
+			{&Verify{}, "requires the \"public_key\" or the \"sha256\" option"},
+			{&Verify{PublicKey: "not a key"}, "\"verify.public_key\" option must be a base64-encoded Ed25519 public key"},
+			{&Verify{PublicKey: base64.StdEncoding.EncodeToString([]byte("short"))}, "\"verify.public_key\" option must be"},
+			{&Verify{SHA256: "abc"}, "\"verify.sha256\" option must be a hex-encoded SHA-256 digest"},
+		}
+
+		for testId, test := range tests {
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{{Url: server.URL, Verify: test.verify}}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+			t.Logf("\tTest %d: Whether the error %q occurs.", testId, test.expected)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+		}
+	}
+
+	t.Log("Given the need to check the verification of the remote lists by the detached signature.")
+	{
+		server := newSignedListServer(t)
+		list := "192.0.2.0/24\n"
+		server.set(list, sign(list))
+
+		dyn := &DynamicCIDR{Url: server.URL + "/list", Verify: &Verify{PublicKey: encodedKey}}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		handler, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+		require.NoErrorf(t, err, "An error should not occur if the signature is valid.")
+
+		plugin := handler.(*ReverseGuard)
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the signed list is accepted.", testId)
+		require.NotNilf(t, plugin.lookupTrustedSet(net.ParseIP("192.0.2.1")), "The IP from the signed list should be trusted.")
+
+		tests := []struct {
+			name      string
+			content   string
+			signature string
+			expected  string
+		}{
+			{"tampered list", "0.0.0.0/0\n", sign(list), "the signature of"},
+			{"list without a signature", "0.0.0.0/0\n", "", "unable to read the signature"},
+			{"malformed signature", "0.0.0.0/0\n", "garbage", "is malformed"},
+			{"list signed by another key", "0.0.0.0/0\n", base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize)), "the signature of"},
+		}
+
+		for _, test := range tests {
+			testId++
+
+			server.set(test.content, test.signature)
+
+			_, err := dyn.update()
+
+			t.Logf("\tTest %d: Whether the %s is rejected and the previous list is kept.", testId, test.name)
+			require.ErrorContainsf(t, err, test.expected, "An error message should contain %q.", test.expected)
+			require.Nilf(t, plugin.lookupTrustedSet(net.ParseIP("198.51.100.1")), "The IP outside the previous list should not be trusted.")
+			require.Lenf(t, dyn.cidrs(), 1, "The previous list should be kept.")
+		}
+
+		testId++
+
+		list = "192.0.2.0/24\n198.51.100.0/24\n"
+		server.set(list, string(ed25519.Sign(privateKey, []byte(list))))
+
+		result, err := dyn.update()
+
+		t.Logf("\tTest %d: Whether the raw signature of the updated list is accepted.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the signature is valid.")
+		require.Equalf(t, 2, result.total, "The updated list should be accepted.")
+	}
+
+	t.Log("Given the need to check the default location of the signature of a list url with a query string.")
+	{
+		server := newSignedListServer(t)
+		list := "192.0.2.0/24\n"
+		server.set(list, sign(list))
+
+		dyn := &DynamicCIDR{Url: server.URL + "/list?v=1", Verify: &Verify{PublicKey: encodedKey}}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the signature is downloaded from %s.", testId, signatureURL(dyn.Url))
+		require.Equalf(t, server.URL+"/list.sig?v=1", signatureURL(dyn.Url), "The suffix should be added to the path.")
+		require.NoErrorf(t, err, "An error should not occur if the signature is valid.")
+		require.Lenf(t, dyn.cidrs(), 1, "The signed list should be accepted.")
+	}
+
+	t.Log("Given the need to check that the headers of the source are not sent to another host of the signature.")
+	{
+		server := newSignedListServer(t)
+		signatureServer := newSignedListServer(t)
+		list := "192.0.2.0/24\n"
+		server.set(list, sign(list))
+		signatureServer.set("", sign(list))
+		// replaced by the first signature request
+		signatureServer.authorization = "not requested"
+
+		headers := map[string]string{"Authorization": "Bearer secret"}
+
+		tests := []struct {
+			server   *signedListServer
+			expected string
+		}{
+			{server, "Bearer secret"},
+			{signatureServer, ""},
+		}
+
+		for testId, test := range tests {
+			dyn := &DynamicCIDR{Url: server.URL + "/list", Headers: headers, Verify: &Verify{PublicKey: encodedKey, SignatureUrl: test.server.URL + "/list.sig"}}
+			items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+			_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+			require.NoErrorf(t, err, "An error should not occur if the signature is valid.")
+
+			test.server.mu.Lock()
+			authorization := test.server.authorization
+			test.server.mu.Unlock()
+
+			t.Logf("\tTest %d: Whether the signature request from %s carries the Authorization header %q.", testId, test.server.URL, test.expected)
+			require.Equalf(t, test.expected, authorization, "The headers should only be sent to the host of the list.")
+		}
+	}
+
+	t.Log("Given the need to check the verification of the lists by the pinned digest.")
+	{
+		list := "192.0.2.0/24\n"
+		sum := sha256.Sum256([]byte(list))
+		digest := hex.EncodeToString(sum[:])
+
+		server := newListServer(t, list)
+		dyn := &DynamicCIDR{Url: server.URL, Verify: &Verify{SHA256: digest}}
+		items := map[string]*ReverseProxy{"partner": {DynamicCIDRs: []*DynamicCIDR{dyn}}}
+
+		_, err := New(ctx, next, &Config{Map: items}, "ReverseGuard")
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the list matching the pinned digest is accepted.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the digest matches.")
+
+		testId++
+
+		server.set("0.0.0.0/0\n")
+		_, err = dyn.update()
+
+		t.Logf("\tTest %d: Whether the list not matching the pinned digest is rejected.", testId)
+		require.ErrorContainsf(t, err, "doesn't match the pinned one", "An error message should contain information about the digest mismatch.")
+		require.Lenf(t, dyn.cidrs(), 1, "The previous list should be kept.")
+	}
+
+	t.Log("Given the need to check the verification of the file lists by the signatures next to them.")
+	{
+		dir := t.TempDir()
+		write := func(name, content string) {
+			require.NoErrorf(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600), "The file %q should be writable.", name)
+		}
+
+		write("a.txt", "192.0.2.0/24\n")
+		write("a.txt.sig", sign("192.0.2.0/24\n"))
+		write("b.txt", "198.51.100.0/24\n")
+		write("b.txt.sig", sign("198.51.100.0/24\n"))
+
+		dyn := &DynamicCIDR{Url: "file://" + dir, Verify: &Verify{PublicKey: encodedKey}}
+		require.NoErrorf(t, dyn.Verify.init(), "The verify options should be valid.")
+
+		result, err := dyn.update()
+
+		testId := 0
+
+		t.Logf("\tTest %d: Whether the signed files of the directory are accepted without the signatures as lists.", testId)
+		require.NoErrorf(t, err, "An error should not occur if the signatures are valid.")
+		require.Equalf(t, 2, result.total, "The subnets of both files should be loaded.")
+
+		testId++
+
+		write("c.txt", "0.0.0.0/0\n")
+		_, err = dyn.update()
+
+		t.Logf("\tTest %d: Whether an unsigned file rejects the whole directory.", testId)
+		require.ErrorContainsf(t, err, "c.txt.sig", "An error message should contain the missing signature.")
+		require.Lenf(t, dyn.cidrs(), 2, "The previous list should be kept.")
+	}
+}